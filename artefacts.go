@@ -0,0 +1,344 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/* ChecksumFile lists the SHA-256 checksum of every artefact in dist, in the
+ * format of sha256sum.
+ */
+const ChecksumFile = `SHA256SUMS`
+
+/* ProvenanceFile describes, in a package, what the artefacts were built from. */
+const ProvenanceFile = `provenance.yml`
+
+/* CheckArtefacts checks that every artefact pattern of the services matches
+ * something in dist.
+ */
+func CheckArtefacts(dist string, compose Compose, services []string) error {
+	var missing []string
+	for _, service := range services {
+		svc := compose.Service(service)
+		if svc == nil {
+			continue
+		}
+		opts, err := ServiceOptionsOf(svc)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range opts.Artefacts {
+			matches, err := filepath.Glob(filepath.Join(dist, pattern))
+			if err != nil {
+				return errors.New(`Invalid artefact pattern ` + pattern + ` in service ` + service + `: ` + err.Error())
+			}
+			if len(matches) == 0 {
+				missing = append(missing, service+`: `+pattern)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("Missing artefacts:\n\t" + strings.Join(missing, "\n\t"))
+	}
+	return nil
+}
+
+/* artefactFiles lists the files in dist, relative to it, in order. */
+func artefactFiles(dist string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dist, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dist, p)
+		if err != nil {
+			return err
+		}
+		if rel != ChecksumFile {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* WriteChecksums writes the checksum of every file in dist to its SHA256SUMS. */
+func WriteChecksums(dist string) error {
+	files, err := artefactFiles(dist)
+	if err != nil {
+		return err
+	}
+	var sums bytes.Buffer
+	for _, file := range files {
+		sum, err := fileChecksum(filepath.Join(dist, file))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", sum, file)
+	}
+	return ioutil.WriteFile(filepath.Join(dist, ChecksumFile), sums.Bytes(), 0644)
+}
+
+/* VerifyChecksums checks the files in dist against its SHA256SUMS, and that
+ * no files have been added since it was written.
+ */
+func VerifyChecksums(dist string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dist, ChecksumFile))
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+	var problems []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), `  `, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		listed[parts[1]] = true
+		sum, err := fileChecksum(filepath.Join(dist, filepath.FromSlash(parts[1])))
+		switch {
+		case err != nil:
+			problems = append(problems, parts[1]+`: `+err.Error())
+		case sum != parts[0]:
+			problems = append(problems, parts[1]+`: checksum mismatch`)
+		}
+	}
+
+	files, err := artefactFiles(dist)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !listed[file] {
+			problems = append(problems, file+`: not in `+ChecksumFile)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("Artefacts do not match " + ChecksumFile + ":\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+/* Provenance records what a package was built from. */
+type Provenance struct {
+	Commit  string  `yaml:"commit"`
+	Dirty   bool    `yaml:"dirty,omitempty"`
+	Created string  `yaml:"created"`
+	Repos   Repos   `yaml:"repos"`
+	Patches Patches `yaml:"patches"`
+}
+
+/* configCommit returns the config commit being built, and whether the
+ * working tree differs from it.
+ */
+func (e *Executor) configCommit() (string, bool, error) {
+	g := gitRepo(e.Dir())
+	rev := `HEAD`
+	if e.at != `` {
+		rev = e.at
+	}
+	b, err := g.git(`rev-parse`, `--verify`, rev+`^{commit}`)
+	if err != nil {
+		return ``, false, err
+	}
+	commit := strings.TrimSpace(string(b))
+	if e.at != `` {
+		return commit, false, nil
+	}
+	b, err = g.git(`status`, `--porcelain`, `--untracked-files=no`)
+	if err != nil {
+		return ``, false, err
+	}
+	return commit, len(bytes.TrimSpace(b)) != 0, nil
+}
+
+/* Package writes dist and its provenance to a tarball named after the
+ * config commit.
+ */
+func (e *Executor) Package() error {
+	out := `.`
+	for e.HasArg() && e.PeekArg() == `--out` {
+		e.PopArg()
+		out = e.PopArg()
+		if out == `` {
+			return errors.New(`No argument provided to --out.`)
+		}
+	}
+
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+	options, err := cfg.Compose.Options()
+	if err != nil {
+		return err
+	}
+	dist, err := e.DistDir(options.Dist)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dist, ChecksumFile)); err != nil {
+		return errors.New(`No checksummed artefacts in ` + dist + `; run tsb build first.`)
+	}
+	err = VerifyChecksums(dist)
+	if err != nil {
+		return err
+	}
+
+	commit, dirty, err := e.configCommit()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf(`%s-%.12s`, filepath.Base(e.Dir()), commit)
+	if dirty {
+		name += `-dirty`
+	}
+	provenance, err := yaml.Marshal(Provenance{
+		Commit:  commit,
+		Dirty:   dirty,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Repos:   cfg.Repos,
+		Patches: cfg.Patches,
+	})
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(out, name+`.tar.gz`)
+	if dryRun {
+		fmt.Printf("Would write %s.\n", file)
+		return nil
+	}
+	err = os.MkdirAll(out, 0755)
+	if err != nil {
+		return err
+	}
+	err = writePackage(file, name, dist, provenance)
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	fmt.Println(file)
+	return nil
+}
+
+/* writePackage writes a gzipped tarball holding, under the directory name,
+ * the provenance and the contents of dist.
+ */
+func writePackage(file, name, dist string, provenance []byte) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name + `/` + ProvenanceFile,
+		Mode:    0644,
+		Size:    int64(len(provenance)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(provenance)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dist, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dist, p)
+		if err != nil {
+			return err
+		}
+		link := ``
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(name, `dist`, rel))
+		if info.IsDir() {
+			hdr.Name += `/`
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,439 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* RevEnv is set to the config commit being tested by tsb bisect. */
+const RevEnv = `TSB_REV`
+
+/* PatchCountEnv is set to the number of patches applied by
+ * tsb bisect-patches.
+ */
+const PatchCountEnv = `TSB_PATCHES`
+
+/* BisectResult is the outcome of testing a config commit. */
+type BisectResult int
+
+const (
+	BisectGood BisectResult = iota
+	BisectBad
+	BisectSkip
+)
+
+func (r BisectResult) String() string {
+	switch r {
+	case BisectGood:
+		return `good`
+	case BisectBad:
+		return `bad`
+	}
+	return `skipped`
+}
+
+/* BisectOptions are the options of the bisect commands. */
+type BisectOptions struct {
+	Build BuildOptions
+	/* Prebuild only prepares the sources in src/, rather than building. */
+	Prebuild bool
+	/* Test is the command that tells good builds from bad. If empty, a
+	 * build is good if it succeeds.
+	 */
+	Test []string
+}
+
+/* BisectOptions consumes the build options of the bisect commands from the
+ * command line.
+ */
+func (e *Executor) BisectOptions() (BisectOptions, error) {
+	var opts BisectOptions
+	var err error
+	for {
+		opts.Build, err = e.BuildOptions()
+		if err != nil {
+			return opts, err
+		}
+		if !e.HasArg() || e.PeekArg() != `--prebuild` {
+			return opts, nil
+		}
+		e.PopArg()
+		opts.Prebuild = true
+	}
+}
+
+/* BisectTest consumes the test command, which follows --, from the command
+ * line.
+ */
+func (e *Executor) BisectTest(opts *BisectOptions) error {
+	if !e.HasArg() || e.PeekArg() != `--` {
+		return nil
+	}
+	e.PopArg()
+	for e.HasArg() {
+		opts.Test = append(opts.Test, e.PopArg())
+	}
+	if len(opts.Test) == 0 {
+		return errors.New(`No command provided after --.`)
+	}
+	return nil
+}
+
+/* bisectEndError is returned by bisect when the candidate at an end of the
+ * range does not test as expected.
+ */
+type bisectEndError struct {
+	Candidate int
+	Result    BisectResult
+}
+
+func (err bisectEndError) Error() string {
+	return fmt.Sprintf("candidate %d is %s", err.Candidate, err.Result)
+}
+
+/* bisect searches candidates 0 to n-1 for the first bad one. Candidate n-1
+ * is tested first and must be bad, then candidate -1, which must be good.
+ * It returns the last known good and the first known bad candidates; if they
+ * are not adjacent, those in between were skipped.
+ */
+func bisect(n int, test func(i int) (BisectResult, error)) (int, int, error) {
+	lo, hi := -1, n-1
+	for _, end := range []struct {
+		candidate int
+		expected  BisectResult
+	}{{hi, BisectBad}, {lo, BisectGood}} {
+		result, err := test(end.candidate)
+		if err != nil {
+			return lo, hi, err
+		}
+		if result != end.expected {
+			return lo, hi, bisectEndError{Candidate: end.candidate, Result: result}
+		}
+	}
+	skipped := make(map[int]bool)
+	for {
+		var untested []int
+		for i := lo + 1; i < hi; i++ {
+			if !skipped[i] {
+				untested = append(untested, i)
+			}
+		}
+		if len(untested) == 0 {
+			return lo, hi, nil
+		}
+		fmt.Printf("Bisecting: %d left to test.\n", len(untested))
+
+		/* Test the untested candidate nearest the middle. */
+		mid := untested[0]
+		for _, i := range untested {
+			if abs(2*i-(lo+hi)) < abs(2*mid-(lo+hi)) {
+				mid = i
+			}
+		}
+		result, err := test(mid)
+		if err != nil {
+			return lo, hi, err
+		}
+		switch result {
+		case BisectGood:
+			lo = mid
+		case BisectBad:
+			hi = mid
+		default:
+			skipped[mid] = true
+		}
+	}
+}
+
+/* Bisect finds the first config commit between a good and a bad one that
+ * fails the test command, or fails to build if there is none, and shows
+ * what it changed. The good and bad commits are tested first, to confirm
+ * that they are.
+ */
+func (e *Executor) Bisect() error {
+	if e.at != `` {
+		return errors.New(`Cannot bisect from alternate revision.`)
+	}
+	if dryRun {
+		return errors.New(`Cannot bisect in a dry run, which builds nothing to test.`)
+	}
+	opts, err := e.BisectOptions()
+	if err != nil {
+		return err
+	}
+	goodRev, badRev := e.PopArg(), e.PopArg()
+	if goodRev == `` || badRev == `` || goodRev == `--` || badRev == `--` {
+		return errors.New(`Usage: tsb bisect [options] {good} {bad} [-- {command...}]`)
+	}
+	err = e.BisectTest(&opts)
+	if err != nil {
+		return err
+	}
+
+	g := gitRepo(e.Dir())
+	resolve := func(rev string) (string, error) {
+		b, err := g.git(`rev-parse`, `--verify`, rev+`^{commit}`)
+		if err != nil {
+			return ``, errors.New(`Unable to resolve ` + rev + `: ` + err.Error())
+		}
+		return string(bytes.TrimSpace(b)), nil
+	}
+	good, err := resolve(goodRev)
+	if err != nil {
+		return err
+	}
+	bad, err := resolve(badRev)
+	if err != nil {
+		return err
+	}
+	if _, err := g.git(`merge-base`, `--is-ancestor`, good, bad); err != nil {
+		return fmt.Errorf("%s is not an ancestor of %s.", goodRev, badRev)
+	}
+	b, err := g.git(`rev-list`, `--reverse`, `--first-parent`, `--ancestry-path`, good+`..`+bad)
+	if err != nil {
+		return err
+	}
+	commits := strings.Fields(string(b))
+	if len(commits) == 0 {
+		return fmt.Errorf("No commits between %s and %s.", goodRev, badRev)
+	}
+
+	/* Candidate -1 is the good commit itself. */
+	lo, hi, err := bisect(len(commits), func(i int) (BisectResult, error) {
+		commit := good
+		if 0 <= i {
+			commit = commits[i]
+		}
+		subject, _ := g.git(`log`, `-n1`, `--format=%h %s`, commit)
+		fmt.Printf("Testing %s\n", bytes.TrimSpace(subject))
+
+		e.at = commit
+		defer func() { e.at = `` }()
+		result, err := e.bisectStep(opts, func() error {
+			cfg, err := e.Config(commit)
+			if err != nil {
+				return err
+			}
+			return e.bisectBuild(opts, cfg)
+		}, RevEnv+`=`+commit)
+		if err == nil {
+			fmt.Printf("%.12s is %s.\n", commit, result)
+		}
+		return result, err
+	})
+	if end, ok := err.(bisectEndError); ok {
+		rev := badRev
+		if end.Candidate < 0 {
+			rev = goodRev
+		}
+		return fmt.Errorf("%s is %s; nothing to bisect.", rev, end.Result)
+	}
+	if err != nil {
+		return err
+	}
+
+	if hi-lo > 1 {
+		fmt.Println(`The first bad commit could be any of:`)
+		for _, commit := range commits[lo+1 : hi+1] {
+			subject, _ := g.git(`log`, `-n1`, `--format=%h %s`, commit)
+			fmt.Printf("\t%s\n", bytes.TrimSpace(subject))
+		}
+		return nil
+	}
+
+	first := commits[hi]
+	subject, _ := g.git(`log`, `-n1`, `--format=%h %s (%an)`, first)
+	fmt.Printf("First bad commit: %s\n\n", bytes.TrimSpace(subject))
+	parent, err := resolve(first + `^`)
+	if err != nil {
+		return err
+	}
+	changelogs, err := NewChangelogs(e.Dir(), parent, first)
+	if err != nil {
+		return err
+	}
+	changelogs.PrintMarkdown(false)
+	return nil
+}
+
+/* BisectPatches finds the first patch of a repository that makes the build
+ * fail the test command, or fail if there is none, by building with ever
+ * fewer of its patches. The build is first confirmed to be bad with all of
+ * them and good with none. The patches file is left as it is.
+ */
+func (e *Executor) BisectPatches() error {
+	if dryRun {
+		return errors.New(`Cannot bisect in a dry run, which builds nothing to test.`)
+	}
+	opts, err := e.BisectOptions()
+	if err != nil {
+		return err
+	}
+	repo := e.PopArg()
+	if repo == `` || repo == `--` {
+		return errors.New(`Usage: tsb bisect-patches [options] {repo} [-- {command...}]`)
+	}
+	err = e.BisectTest(&opts)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Repos[repo]; !ok {
+		return fmt.Errorf(`"%s" is not a valid repository.`, repo)
+	}
+	patches := cfg.Patches[repo]
+	if len(patches) == 0 {
+		return errors.New(`Repository ` + repo + ` has no patches.`)
+	}
+
+	/* Candidate i applies the first i+1 patches, so -1 applies none. */
+	lo, hi, err := bisect(len(patches), func(i int) (BisectResult, error) {
+		if i < 0 {
+			fmt.Printf("Testing with none of %d patches\n", len(patches))
+		} else {
+			fmt.Printf("Testing with %d of %d patches, up to %s\n", i+1, len(patches), patches[i].Describe())
+		}
+		cfg.Patches[repo] = patches[:i+1]
+		defer func() { cfg.Patches[repo] = patches }()
+		result, err := e.bisectStep(opts, func() error {
+			return e.bisectBuild(opts, cfg)
+		}, fmt.Sprintf(`%s=%d`, PatchCountEnv, i+1))
+		if err == nil {
+			fmt.Printf("%d of %d patches: %s.\n", i+1, len(patches), result)
+		}
+		return result, err
+	})
+	if end, ok := err.(bisectEndError); ok {
+		if end.Candidate < 0 {
+			return fmt.Errorf("Without its patches, %s is %s; nothing to bisect.", repo, end.Result)
+		}
+		return fmt.Errorf("With all %d of its patches, %s is %s; nothing to bisect.", len(patches), repo, end.Result)
+	}
+	if err != nil {
+		return err
+	}
+
+	if hi-lo > 1 {
+		fmt.Println(`The first bad patch could be any of:`)
+		for i := lo + 1; i <= hi; i++ {
+			fmt.Printf("\t%d: %s\n", i+1, patches[i].Describe())
+		}
+		return nil
+	}
+	fmt.Printf("First bad patch of %s: %d: %s\n", repo, hi+1, patches[hi].Describe())
+	return nil
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+/* bisectStep runs build and then the test command, with env added to its
+ * environment. Builds that fail are skipped if there is a test command,
+ * and bad if there is not.
+ */
+func (e *Executor) bisectStep(opts BisectOptions, build func() error, env ...string) (BisectResult, error) {
+	err := build()
+	if _, ok := err.(Interrupted); ok {
+		return BisectSkip, err
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Build failed: %s\n", err.Error())
+		if len(opts.Test) == 0 {
+			return BisectBad, nil
+		}
+		return BisectSkip, nil
+	}
+	if len(opts.Test) == 0 {
+		return BisectGood, nil
+	}
+
+	cmd := exec.CommandContext(runContext, opts.Test[0], opts.Test[1:]...)
+	cmd.Dir = e.Dir()
+	cmd.Env = append(os.Environ(), env...)
+	if opts.Prebuild {
+		cmd.Env = append(cmd.Env, SrcEnv+`=`+filepath.Join(e.Dir(), `src`))
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if runContext.Err() != nil {
+		return BisectSkip, Interrupted{Signal: interruptSignal}
+	}
+	if err == nil {
+		return BisectGood, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return BisectSkip, errors.New(`Unable to run ` + opts.Test[0] + `: ` + err.Error())
+	}
+	/* As for git bisect run: 125 skips, and codes above 127 give up. */
+	switch code := exitErr.ExitCode(); {
+	case code == 125:
+		return BisectSkip, nil
+	case code < 0 || code > 127:
+		return BisectSkip, fmt.Errorf("Test command exited with %d; giving up.", code)
+	}
+	return BisectBad, nil
+}
+
+/* bisectBuild prebuilds or builds cfg, within its timeout. */
+func (e *Executor) bisectBuild(opts BisectOptions, cfg *Config) error {
+	for name, repo := range cfg.Repos {
+		/* Repositories added since the last fetch. */
+		if _, err := os.Stat(filepath.Join(e.Dir(), `src`, name, `.git`)); err != nil {
+			err = repo.Fetch(e.Dir(), name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	build := opts.Build
+	if build.Timeout == 0 {
+		options, err := cfg.Compose.Options()
+		if err != nil {
+			return err
+		}
+		build.Timeout = time.Duration(options.Timeout)
+	}
+	restore := withTimeout(build.Timeout)
+	defer restore()
+	var err error
+	if opts.Prebuild {
+		err = e.Prebuild(cfg, ``)
+	} else {
+		err = e.BuildInWorktree(cfg, build, true)
+	}
+	return e.Cancelled(err, build.Timeout)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBisect(t *testing.T) {
+	failed := errors.New(`failed`)
+	for _, tc := range []struct {
+		name    string
+		n       int
+		results map[int]BisectResult
+		/* firstBad makes candidates without a result good before it and bad from it on. */
+		firstBad int
+		fail     int
+		lo, hi   int
+		err      error
+		tested   []int
+	}{
+		{name: `first`, n: 5, firstBad: 0, lo: -1, hi: 0, tested: []int{4, -1, 1, 0}},
+		{name: `middle`, n: 8, firstBad: 5, lo: 4, hi: 5, tested: []int{7, -1, 3, 5, 4}},
+		{name: `last`, n: 5, firstBad: 4, lo: 3, hi: 4, tested: []int{4, -1, 1, 2, 3}},
+		{name: `single`, n: 1, firstBad: 0, lo: -1, hi: 0, tested: []int{0, -1}},
+		{
+			name: `skipped`, n: 6, firstBad: 3, results: map[int]BisectResult{2: BisectSkip, 3: BisectSkip},
+			lo: 1, hi: 4, tested: []int{5, -1, 2, 1, 3, 4},
+		},
+		{
+			name: `all good`, n: 5, firstBad: 5,
+			lo: -1, hi: 4, err: bisectEndError{Candidate: 4, Result: BisectGood}, tested: []int{4},
+		},
+		{
+			name: `last skipped`, n: 5, firstBad: 0, results: map[int]BisectResult{4: BisectSkip},
+			lo: -1, hi: 4, err: bisectEndError{Candidate: 4, Result: BisectSkip}, tested: []int{4},
+		},
+		{
+			name: `base bad`, n: 5, firstBad: -1,
+			lo: -1, hi: 4, err: bisectEndError{Candidate: -1, Result: BisectBad}, tested: []int{4, -1},
+		},
+		{
+			name: `base skipped`, n: 5, firstBad: 2, results: map[int]BisectResult{-1: BisectSkip},
+			lo: -1, hi: 4, err: bisectEndError{Candidate: -1, Result: BisectSkip}, tested: []int{4, -1},
+		},
+		{name: `test error`, n: 8, firstBad: 5, fail: 3, lo: -1, hi: 7, err: failed, tested: []int{7, -1, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tested []int
+			lo, hi, err := bisect(tc.n, func(i int) (BisectResult, error) {
+				tested = append(tested, i)
+				if tc.fail != 0 && i == tc.fail {
+					return BisectSkip, failed
+				}
+				if result, ok := tc.results[i]; ok {
+					return result, nil
+				}
+				if i < tc.firstBad {
+					return BisectGood, nil
+				}
+				return BisectBad, nil
+			})
+			if err != tc.err {
+				t.Errorf("Expected error %v, got %v", tc.err, err)
+			}
+			if lo != tc.lo || hi != tc.hi {
+				t.Errorf("Expected %d..%d, got %d..%d", tc.lo, tc.hi, lo, hi)
+			}
+			if !reflect.DeepEqual(tested, tc.tested) {
+				t.Errorf("Expected to test %v, got %v", tc.tested, tested)
+			}
+		})
+	}
+}
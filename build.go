@@ -0,0 +1,434 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/* Prebuild checks out the head of every repository and applies its patches,
+ * in the worktree w, or in src/ itself if w is empty.
+ */
+func (e *Executor) Prebuild(cfg *Config, w Worktree) error {
+	dir := e.Dir()
+	if w != `` {
+		dir = string(w)
+	}
+	e.OnCancel(func() { cfg.Repos.AbortInProgress(dir) })
+	var err error
+	if w == `` {
+		err = cfg.Repos.Prepare(dir)
+	} else {
+		err = cfg.Repos.PrepareWorktree(e.Dir(), w)
+	}
+	if err != nil {
+		return err
+	}
+	return e.ApplyPatches(cfg, dir)
+}
+
+/* BuildInWorktree prebuilds cfg in a worktree of its own, and builds it if
+ * build is set. The worktree is removed afterwards.
+ */
+func (e *Executor) BuildInWorktree(cfg *Config, opts BuildOptions, build bool) error {
+	w, err := e.NewWorktree(cfg)
+	if err != nil {
+		return err
+	}
+	remove := func() { cfg.Repos.RemoveWorktree(e.Dir(), w) }
+	/* If cancelled, remove it once the other cleanups are done with it. */
+	e.OnCancel(remove)
+	defer func() {
+		if runContext.Err() == nil {
+			remove()
+		}
+	}()
+
+	err = e.Prebuild(cfg, w)
+	if err != nil || !build {
+		return err
+	}
+	return e.Build(cfg, opts, w)
+}
+
+/* ApplyPatches applies the patches to the checkouts in src/ of dir. */
+func (e *Executor) ApplyPatches(cfg *Config, dir string) error {
+	var err error
+	for name, repo := range cfg.Repos {
+		if cfg.Patches[name] != nil {
+			for _, patch_item := range cfg.Patches[name] {
+				chg := patch_item.Change
+				if chg.Node != "" {
+					if repo.BuildStrategy == BuildStrategyMerge {
+						err = repo.Merge(dir, name, chg.Node)
+					} else { // default to cherry
+						err = repo.Cherry(dir, name, chg.Node)
+						if verbose {
+							fmt.Fprintf(os.Stderr, "build-strategy for '%s' fallback to 'cherry'.\n", name)
+						}
+					}
+					if err != nil {
+						return NewPatchError(err, name, chg.Node)
+					}
+				} else if patch_item.Sub != nil {
+					if len(patch_item.Sub.Changesets) > 0 {
+						for _, changeset := range patch_item.Sub.Changesets {
+							if repo.BuildStrategy == BuildStrategyCherry {
+								err = repo.Cherry(dir, name, changeset.Node)
+							} else if repo.BuildStrategy == BuildStrategyMerge {
+								err = repo.Merge(dir, name, changeset.Node)
+							} else {
+								return fmt.Errorf("Unrecognized build strategy %s in repo yaml file", repo.BuildStrategy)
+							}
+							if err != nil {
+								return NewPatchError(err, name, changeset.Node)
+							}
+						}
+					}
+				} else if patch_item.File != nil {
+					err = e.ApplyPatchFile(repo, dir, name, patch_item.File)
+					if err != nil {
+						return NewPatchError(err, name, patch_item.File.Path)
+					}
+				} else {
+					return errors.New(`Unrecognized format in patches yaml file`)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/* BuildOptions are the options of the build command. */
+type BuildOptions struct {
+	/* Profiles are the compose profiles to enable; COMPOSE_PROFILES if empty. */
+	Profiles []string
+	/* Engine overrides the engine set in the compose file. */
+	Engine string
+	/* Force builds even if an identical build has succeeded before. */
+	Force bool
+	/* NoCache neither uses nor fills the build cache, and builds images
+	 * without cached layers.
+	 */
+	NoCache bool
+	/* Timeout limits the whole build; the x-tsb timeout if zero. */
+	Timeout time.Duration
+}
+
+/* BuildOptions consumes the build options from the command line. */
+func (e *Executor) BuildOptions() (BuildOptions, error) {
+	var opts BuildOptions
+	for e.HasArg() {
+		switch e.PeekArg() {
+		case `--profile`:
+			e.PopArg()
+			profile := e.PopArg()
+			if profile == `` {
+				return opts, errors.New(`No argument provided to --profile.`)
+			}
+			opts.Profiles = append(opts.Profiles, profile)
+		case `--force`:
+			e.PopArg()
+			opts.Force = true
+		case `--no-cache`:
+			e.PopArg()
+			opts.NoCache = true
+		case `--timeout`:
+			e.PopArg()
+			arg := e.PopArg()
+			timeout, err := time.ParseDuration(arg)
+			if err != nil {
+				return opts, errors.New(`Invalid --timeout ` + arg + `: ` + err.Error())
+			}
+			opts.Timeout = timeout
+		case `--engine`:
+			e.PopArg()
+			opts.Engine = e.PopArg()
+			if opts.Engine == `` {
+				return opts, errors.New(`No argument provided to --engine.`)
+			}
+		default:
+			return opts, nil
+		}
+	}
+	return opts, nil
+}
+
+/* Engine returns the build engine: the one given on the command line, or
+ * in the compose file, or the first available.
+ */
+func (e *Executor) Engine(cfg *Config, opts BuildOptions) (BuildEngine, error) {
+	if e.engine != nil {
+		return e.engine, nil
+	}
+	name := opts.Engine
+	if name == `` {
+		options, err := cfg.Compose.Options()
+		if err != nil {
+			return nil, err
+		}
+		name = options.Engine
+	}
+	return FindEngine(name)
+}
+
+/* Build runs every compose service enabled by the profiles against the
+ * prepared sources.
+ */
+func (e *Executor) Build(cfg *Config, opts BuildOptions, w Worktree) error {
+	profiles := opts.Profiles
+	if len(profiles) == 0 {
+		profiles = cfg.ComposeProfiles
+	}
+	services := cfg.Compose.EnabledServiceNames(profiles)
+	enabled := make(map[string]bool)
+	for _, service := range services {
+		enabled[service] = true
+	}
+
+	engine, err := e.Engine(cfg, opts)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Building with %s.\n", engine.Name())
+	}
+	_, host := engine.(HostEngine)
+
+	var fatal []string
+	for _, issue := range cfg.Compose.Issues(host) {
+		if issue.Service != `` && !enabled[issue.Service] {
+			continue
+		}
+		if issue.Fatal {
+			fatal = append(fatal, issue.String())
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", issue)
+		}
+	}
+	if len(fatal) > 0 {
+		return errors.New("Unsupported compose file:\n" + strings.Join(fatal, "\n"))
+	}
+	if len(services) == 0 {
+		return errors.New(`No services are enabled by profiles ` + strings.Join(profiles, `, `) + `.`)
+	}
+
+	options, err := cfg.Compose.Options()
+	if err != nil {
+		return err
+	}
+	dist, err := e.DistDir(options.Dist)
+	if err != nil {
+		return err
+	}
+	dir := e.Dir()
+	if e.at != `` {
+		dir, err = e.CheckoutConfig(w)
+		if err != nil {
+			return err
+		}
+	}
+	project := Project{
+		Dir:      dir,
+		Files:    cfg.ComposeFiles,
+		Profiles: profiles,
+		Compose:  cfg.Compose,
+		NoCache:  opts.NoCache,
+		Src:      w.Src(),
+		Dist:     dist,
+	}
+
+	cache := BuildCache(options.CacheDir)
+	if cache == `` {
+		cache = DefaultBuildCache()
+	}
+	if opts.NoCache {
+		cache = ``
+	}
+	if dryRun && e.at != `` {
+		/* The key covers the build contexts of the revision, which a dry
+		 * run does not check out.
+		 */
+		cache = ``
+	}
+
+	var key string
+	if cache != `` {
+		key, err = e.BuildKey(cfg, project, services, engine)
+		if err != nil {
+			return err
+		}
+		if !opts.Force && cache.Has(key) {
+			if _, err := os.Stat(dist); err == nil && cache.Last(e.Dir()) == key {
+				fmt.Printf("Build %.12s is up to date.\n", key)
+				return nil
+			}
+			if dryRun {
+				fmt.Printf("Would restore %s from build %.12s.\n", dist, key)
+				return nil
+			}
+			err = cache.Restore(key, dist)
+			if err != nil {
+				return err
+			}
+			if options.Dist == DistPerBuild {
+				if err := e.linkLatest(dist); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Restored %s from build %.12s.\n", dist, key)
+			return cache.SetLast(e.Dir(), key)
+		}
+	}
+
+	/* Let the compose file mount the sources as ${TSB_SRC} and the output
+	 * directory as ${TSB_DIST}, for this build only.
+	 */
+	restore, err := setEnv(SrcEnv, project.Src, DistEnv, dist)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	project.Compose, _, _, err = LoadCompose(e.ConfigRoot(e.at))
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		/* The host engine mounts nothing. */
+		if svc := project.Compose.Service(service); host || svc == nil || !svc.MountsSrc() {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Warning: service %s mounts src/ rather than ${%s:-./src}, so it does not see the sources of this build.\n", service, SrcEnv)
+	}
+
+	if !dryRun {
+		err = prepareDist(options.Dist, dist)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.OnCancel(func() {
+		if err := engine.Stop(runContext, project); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to stop services: %s\n", err.Error())
+		}
+	})
+	for _, service := range services {
+		err := e.buildService(engine, project, service)
+		if err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	err = CheckArtefacts(dist, cfg.Compose, services)
+	if err != nil {
+		return err
+	}
+	err = WriteChecksums(dist)
+	if err != nil {
+		return errors.New(`Unable to write checksums: ` + err.Error())
+	}
+	if options.Dist == DistPerBuild {
+		err = e.linkLatest(dist)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cache == `` {
+		return nil
+	}
+	err = cache.Save(key, dist)
+	if err != nil {
+		return errors.New(`Unable to cache build: ` + err.Error())
+	}
+	return cache.SetLast(e.Dir(), key)
+}
+
+/* setEnv sets pairs of environment variables and values, and returns a
+ * function that restores the variables to what they were.
+ */
+func setEnv(pairs ...string) (func(), error) {
+	type saved struct {
+		value string
+		set   bool
+	}
+	previous := make(map[string]saved)
+	restore := func() {
+		for name, old := range previous {
+			if old.set {
+				os.Setenv(name, old.value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value, set := os.LookupEnv(pairs[i])
+		previous[pairs[i]] = saved{value, set}
+		if err := os.Setenv(pairs[i], pairs[i+1]); err != nil {
+			restore()
+			return nil, err
+		}
+	}
+	return restore, nil
+}
+
+/* buildService builds the image of a service and runs it, within its
+ * timeout.
+ */
+func (e *Executor) buildService(engine BuildEngine, project Project, service string) error {
+	opts, err := project.ServiceOptions(service)
+	if err != nil {
+		return err
+	}
+	ctx := inProcessGroup(runContext)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.Timeout))
+		defer cancel()
+	}
+	timedOut := func(err error) error {
+		/* Only this service's own timeout; the build's is handled by the caller. */
+		if ctx.Err() == context.DeadlineExceeded && runContext.Err() == nil {
+			if err := engine.Stop(runContext, project); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to stop %s: %s\n", service, err.Error())
+			}
+			return TimedOut{After: time.Duration(opts.Timeout)}
+		}
+		return err
+	}
+
+	err = engine.BuildImage(ctx, project, service)
+	if err != nil {
+		return timedOut(errors.New(`Unable to create build image ` + service + `: ` + err.Error()))
+	}
+
+	err = engine.RunService(ctx, project, service)
+	if err != nil {
+		return timedOut(errors.New(`Failed to build ` + service + `: ` + err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/* BuildCache keeps the dist directory of successful builds, by build key. */
+type BuildCache string
+
+/* DefaultBuildCache is the user's cache directory, or none if it has none. */
+func DefaultBuildCache() BuildCache {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ``
+	}
+	return BuildCache(filepath.Join(dir, `tsb`))
+}
+
+func (c BuildCache) entry(key string) string {
+	return filepath.Join(string(c), `builds`, key)
+}
+
+/* Has reports whether a build with the key has succeeded before. */
+func (c BuildCache) Has(key string) bool {
+	_, err := os.Stat(filepath.Join(c.entry(key), `ok`))
+	return err == nil
+}
+
+/* Save stores the dist directory of a successful build. */
+func (c BuildCache) Save(key, dist string) error {
+	entry := c.entry(key)
+	err := os.RemoveAll(entry)
+	if err != nil {
+		return err
+	}
+	err = copyTree(dist, filepath.Join(entry, `dist`))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(entry, `ok`), []byte(key+"\n"), 0644)
+}
+
+/* Restore replaces the dist directory with that of a cached build. */
+func (c BuildCache) Restore(key, dist string) error {
+	err := os.RemoveAll(dist)
+	if err != nil {
+		return err
+	}
+	return copyTree(filepath.Join(c.entry(key), `dist`), dist)
+}
+
+/* lastFile records the key of the last build in a config repository. */
+func (c BuildCache) lastFile(dir string) string {
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(string(c), `last`, hex.EncodeToString(sum[:]))
+}
+
+/* Last returns the key of the last build in a config repository. */
+func (c BuildCache) Last(dir string) string {
+	b, err := ioutil.ReadFile(c.lastFile(dir))
+	if err != nil {
+		return ``
+	}
+	return strings.TrimSpace(string(b))
+}
+
+/* SetLast records the key of the last build in a config repository. */
+func (c BuildCache) SetLast(dir, key string) error {
+	file := c.lastFile(dir)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(key+"\n"), 0644)
+}
+
+/* copyTree copies a directory, keeping file modes and symlinks. */
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+/* hashTree adds the paths, modes and contents of the files below dir to h,
+ * skipping the directories in skip.
+ */
+func hashTree(h hash.Hash, dir string, skip map[string]bool) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if skip[p] || info.Name() == `.git` {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == `.git` {
+			/* The .git file of a worktree. */
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		fmt.Fprintf(h, "%s %o\n", filepath.ToSlash(rel), info.Mode())
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s\n", link)
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+}
+
+/* BuildKey identifies the inputs of a build: the repository heads, the
+ * patches (including the contents of patch files), the merged compose file,
+ * the build contexts and Dockerfiles of the services, and the engine.
+ */
+func (e *Executor) BuildKey(cfg *Config, project Project, services []string, engine BuildEngine) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "engine %s\nprofiles %s\nservices %s\n", engine.Name(), strings.Join(project.Profiles, `,`), strings.Join(services, `,`))
+
+	for _, part := range []interface{}{cfg.Repos, cfg.Patches, cfg.Compose} {
+		b, err := yaml.Marshal(part)
+		if err != nil {
+			return ``, err
+		}
+		h.Write(b)
+	}
+
+	var repos []string
+	for repo := range cfg.Patches {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		for _, p := range cfg.Patches[repo] {
+			if p.File == nil {
+				continue
+			}
+			b, err := p.File.Read(e.ConfigRoot(e.at))
+			if err != nil {
+				return ``, err
+			}
+			fmt.Fprintf(h, "file %s\n", p.File.Path)
+			h.Write(b)
+		}
+	}
+
+	/* The sources and artefacts are covered by the heads and patches. */
+	skip := map[string]bool{
+		filepath.Join(project.Dir, `src`):  true,
+		filepath.Join(project.Dir, `dist`): true,
+	}
+	contexts := make(map[string]bool)
+	for _, service := range services {
+		svc := project.Compose.Service(service)
+		if svc == nil || (svc.Build.Context == `` && svc.Build.Dockerfile == ``) {
+			continue
+		}
+		context := project.Path(svc.Build.Context)
+		if !contexts[context] {
+			contexts[context] = true
+			fmt.Fprintf(h, "context %s\n", service)
+			err := hashTree(h, context, skip)
+			if err != nil {
+				return ``, err
+			}
+		}
+		if svc.Build.Dockerfile != `` {
+			b, err := ioutil.ReadFile(filepath.Join(context, svc.Build.Dockerfile))
+			if err != nil {
+				return ``, err
+			}
+			fmt.Fprintf(h, "dockerfile %s\n", service)
+			h.Write(b)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/* runContext is the context commands are run in. It is cancelled by SIGINT
+ * and SIGTERM, and carries the deadline of the build, if any.
+ */
+var runContext = context.Background()
+
+/* interruptSignal is the signal that cancelled runContext. It is set before
+ * the cancellation, so it may be read once runContext is done.
+ */
+var interruptSignal os.Signal
+
+/* handleSignals cancels runContext on the first SIGINT or SIGTERM, so that
+ * tsb can clean up, and exits at once on the second.
+ */
+func handleSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	runContext = ctx
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		interruptSignal = sig
+		fmt.Fprintf(os.Stderr, "Received %s; cleaning up. Repeat to exit at once.\n", sig)
+		cancel()
+
+		sig = <-signals
+		os.Exit(Interrupted{Signal: sig}.ExitCode())
+	}()
+}
+
+type processGroupKey struct{}
+
+/* inProcessGroup marks commands run with the returned context to be run in
+ * their own process group, so that cancelling them kills their children
+ * too. Commands that may prompt on the terminal must not be.
+ */
+func inProcessGroup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, processGroupKey{}, true)
+}
+
+/* withTimeout limits the commands run until restore is called to d. */
+func withTimeout(d time.Duration) (restore func()) {
+	if d <= 0 {
+		return func() {}
+	}
+	prev := runContext
+	ctx, cancel := context.WithTimeout(prev, d)
+	runContext = ctx
+	return func() {
+		cancel()
+		runContext = prev
+	}
+}
+
+/* OnCancel registers fn to clean up if the current command is interrupted
+ * or times out.
+ */
+func (e *Executor) OnCancel(fn func()) {
+	e.cleanups = append(e.cleanups, fn)
+}
+
+/* Cancelled runs the cleanups registered by the current command if it was
+ * interrupted or timed out, and returns the error to report.
+ */
+func (e *Executor) Cancelled(err error, timeout time.Duration) error {
+	cleanups := e.cleanups
+	e.cleanups = nil
+
+	cause := runContext.Err()
+	if cause == nil {
+		return err
+	}
+	if _, ok := err.(Interrupted); ok {
+		return err
+	}
+
+	/* Clean up with a fresh context, since runContext is done. */
+	prev := runContext
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	runContext = ctx
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cancel()
+	runContext = prev
+
+	if cause == context.DeadlineExceeded {
+		return TimedOut{After: timeout}
+	}
+	return Interrupted{Signal: interruptSignal}
+}
+
+/* AbortInProgress aborts any cherry-pick, merge, revert or git am left
+ * unfinished in the sources, and removes index locks left by killed git
+ * commands.
+ */
+func (rs Repos) AbortInProgress(dir string) {
+	for name := range rs {
+		repo := gitRepo(filepath.Join(dir, `src`, name))
+		_ = os.Remove(filepath.Join(repo.gitDir(), `index.lock`))
+
+		for _, op := range []struct{ marker, cmd string }{
+			{`CHERRY_PICK_HEAD`, `cherry-pick`},
+			{`REVERT_HEAD`, `revert`},
+			{`MERGE_HEAD`, `merge`},
+			{`rebase-apply`, `am`},
+		} {
+			if _, err := os.Stat(filepath.Join(repo.gitDir(), op.marker)); err != nil {
+				continue
+			}
+			if _, err := repo.git(op.cmd, `--abort`); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to abort %s in src/%s: %s\n", op.cmd, name, err.Error())
+			} else {
+				fmt.Fprintf(os.Stderr, "Aborted %s in src/%s.\n", op.cmd, name)
+			}
+		}
+	}
+}
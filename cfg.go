@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -32,7 +33,14 @@ import (
 type Config struct {
 	Repos   Repos   `file:"yaml,repos.yml"`
 	Patches Patches `file:"yaml,patches.yml"`
-	Compose Compose `file:"yaml,docker-compose.yml"`
+	/* Compose is loaded separately by LoadCompose, since it must be
+	 * interpolated, and is never written back.
+	 */
+	Compose Compose `yaml:"-"`
+	/* ComposeFiles are the compose files merged into Compose, in order. */
+	ComposeFiles []string `yaml:"-"`
+	/* ComposeProfiles are the profiles enabled by COMPOSE_PROFILES. */
+	ComposeProfiles []string `yaml:"-"`
 }
 
 type Repos map[string]*Repo
@@ -49,6 +57,22 @@ const (
 	BuildStrategyInvalid = BuildStrategy("")
 )
 
+type MergePolicy string
+
+const (
+	// MergePolicyFail refuses to refresh a subscription containing merges. This
+	// is the default.
+	MergePolicyFail = MergePolicy("fail")
+	// MergePolicySkip leaves merge commits out of a subscription.
+	MergePolicySkip = MergePolicy("skip")
+	// MergePolicyFirstParent follows only the first parent of merges in a
+	// subscription, applying each merge relative to that parent.
+	MergePolicyFirstParent = MergePolicy("first-parent")
+	// MergePolicyInvalid represents an unset MergePolicy, which is treated as
+	// MergePolicyFail.
+	MergePolicyInvalid = MergePolicy("")
+)
+
 type Repo struct {
 	Source        string        `yaml:"src"`
 	BuildStrategy BuildStrategy `yaml:"build-strategy,omitempty"`
@@ -59,8 +83,12 @@ type Repo struct {
 }
 
 type Subscription struct {
-	Branch     string      `yaml:"branch"`
-	Changesets []Changeset `yaml:"changesets,omitempty"`
+	Branch     string              `yaml:"branch"`
+	Merges     MergePolicy         `yaml:"merges,omitempty"`
+	Include    *SubscriptionFilter `yaml:"include,omitempty"`
+	Exclude    *SubscriptionFilter `yaml:"exclude,omitempty"`
+	Upstream   *Upstream           `yaml:"upstream,omitempty"`
+	Changesets []Changeset         `yaml:"changesets,omitempty"`
 }
 
 type Changeset struct {
@@ -72,6 +100,17 @@ type Changeset struct {
 type Patch struct {
 	Change Changeset
 	Sub    *Subscription
+	File   *PatchFile
+	/* Upstream describes the upstreaming of Change. Subscriptions and patch
+	 * files carry their own.
+	 */
+	Upstream *Upstream
+}
+
+/* commitPatch is the form of a changeset patch that carries metadata. */
+type commitPatch struct {
+	Commit   Changeset `yaml:"commit"`
+	Upstream *Upstream `yaml:"upstream,omitempty"`
 }
 
 type Patches map[string][]Patch
@@ -106,10 +145,14 @@ func (l Extra) MarshalYAML() (interface{}, error) {
 }
 
 func (l Patch) MarshalYAML() (interface{}, error) {
-	if l.Change.Node != "" {
+	if l.Change.Node != "" && l.Upstream != nil {
+		return commitPatch{Commit: l.Change, Upstream: l.Upstream}, nil
+	} else if l.Change.Node != "" {
 		return l.Change, nil
 	} else if l.Sub != nil {
 		return l.Sub, nil
+	} else if l.File != nil {
+		return l.File, nil
 	} else {
 		return nil, errors.New("Attempting to Marsahal invalid patch")
 	}
@@ -128,7 +171,21 @@ func (l *Patch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return nil
 		}
 	}
-	return errors.New("Not a string or valid subscription")
+	var file PatchFile
+	if err := unmarshal(&file); err == nil {
+		if file.Path != "" {
+			*l = Patch{File: &file}
+			return nil
+		}
+	}
+	var commit commitPatch
+	if err := unmarshal(&commit); err == nil {
+		if commit.Commit.Node != "" {
+			*l = Patch{Change: commit.Commit, Upstream: commit.Upstream}
+			return nil
+		}
+	}
+	return errors.New("Not a string, valid subscription, patch file or commit")
 }
 
 func (cs *Changeset) UnmarshalYAML(value *yaml.Node) error {
@@ -208,6 +265,11 @@ func (r *Repo) Fetch(dir string, name string) error {
 
 	/* Clone the repo if it isn't already there. */
 	if fi, err := os.Stat(gitDir); err != nil || !fi.IsDir() {
+		if dryRun {
+			/* There is no clone to set up the remotes of. */
+			_, err := git(`clone`, `--no-checkout`, r.Source, repoDir)
+			return err
+		}
 		_ = os.RemoveAll(repoDir)
 		_, err := git(`clone`, `--no-checkout`, r.Source, repoDir)
 		if err != nil {
@@ -318,15 +380,9 @@ func (r *Repo) Update(dir, name string) error {
 			return errors.New(`Unable to get head of branch origin/` + r.Branch + `: ` + err.Error())
 		}
 	} else if r.Tag != "" {
-
-		_, err := repo.git(`checkout`, `-B`, r.Tag+`_local`, r.Tag)
-		if err != nil {
-			return errors.New(`Unable to create branch from Tag ` + r.Tag + `: ` + err.Error())
-		}
-
-		newhead, err = repo.git(`log`, `-n1`, `--format=%H`, r.Tag+`_local`)
+		newhead, err = repo.git(`rev-parse`, `--verify`, r.Tag+`^{commit}`)
 		if err != nil {
-			return errors.New(`Unable to get head of branch ` + r.Tag + `_local` + `: ` + err.Error())
+			return errors.New(`Unable to resolve Tag ` + r.Tag + `: ` + err.Error())
 		}
 	}
 	newhead = bytes.TrimSpace(newhead)
@@ -337,6 +393,35 @@ func (r *Repo) Update(dir, name string) error {
 	return nil
 }
 
+/* UpdateTo sets the head to rev rather than the tip of the tracked branch.
+ * A rev that is not reachable from the tracked branch or tag is accepted, but
+ * warned about.
+ */
+func (r *Repo) UpdateTo(dir, name, rev string) error {
+	repo := gitRepo(filepath.Join(dir, `src`, name))
+
+	newhead, err := repo.git(`rev-parse`, `--verify`, rev+`^{commit}`)
+	if err != nil {
+		return errors.New(`Unable to resolve ` + rev + ` in ` + name + `: ` + err.Error())
+	}
+	r.Head = string(bytes.TrimSpace(newhead))
+
+	base := r.Tag
+	if r.Branch != "" {
+		base = path.Join(`origin`, r.Branch)
+	}
+	if base != "" {
+		if _, err := repo.git(`merge-base`, `--is-ancestor`, r.Head, base); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s (%s) is not reachable from %s in %s.\n", rev, r.Head, base, name)
+		}
+	}
+
+	if r.BuildStrategy == BuildStrategyInvalid {
+		r.BuildStrategy = BuildStrategyCherry
+	}
+	return nil
+}
+
 func (r *Repo) Prepare(dir, name string) error {
 	repo := gitRepo(filepath.Join(dir, `src`, name))
 	_, _ = repo.git(`clean`, `-dfx`) /* Don't complain about a failed clean, checkout will complain if necessary. */
@@ -349,7 +434,16 @@ func (r *Repo) Prepare(dir, name string) error {
 
 func (r *Repo) Cherry(dir, name, changeset string) error {
 	repo := gitRepo(filepath.Join(dir, `src`, name))
-	_, err := repo.git(`cherry-pick`, changeset)
+	merge, err := repo.isMerge(changeset)
+	if err != nil {
+		return err
+	}
+	if merge {
+		/* Merges only come from first-parent subscriptions, so pick them relative to that parent. */
+		_, err = repo.git(`cherry-pick`, `-m`, `1`, changeset)
+		return err
+	}
+	_, err = repo.git(`cherry-pick`, changeset)
 	return err
 }
 
@@ -359,6 +453,71 @@ func (r *Repo) Merge(dir, name, changeset string) error {
 	return err
 }
 
+/* Refresh recomputes the changesets of the subscription as those on its
+ * branch that are not in base. If the branch no longer exists on its remote,
+ * a warning is printed and the recorded changesets are kept.
+ */
+func (s *Subscription) Refresh(dir, name, base string) error {
+	repo := gitRepo(filepath.Join(dir, `src`, name))
+
+	if s.Vanished(repo) {
+		fmt.Fprintf(os.Stderr, "Warning: subscribed branch %s has vanished from %s; keeping its %d recorded changesets.\n", s.Branch, name, len(s.Changesets))
+		return nil
+	}
+
+	args := []string{`log`, `--reverse`, ChangesetGitFormatArg}
+	switch s.Merges {
+	case MergePolicyFail, MergePolicyInvalid:
+		merges, err := repo.git(`log`, `--merges`, `--format=%H`, base+`..`+s.Branch)
+		if err != nil {
+			return err
+		}
+		if merges = bytes.TrimSpace(merges); len(merges) != 0 {
+			return fmt.Errorf("Subscription to %s in %s contains merges; set merges to skip or first-parent to accept them:\n%s", s.Branch, name, merges)
+		}
+	case MergePolicySkip:
+		args = append(args, `--no-merges`)
+	case MergePolicyFirstParent:
+		args = append(args, `--first-parent`)
+	default:
+		return fmt.Errorf("Unrecognized merge policy %s for subscription to %s in %s", s.Merges, s.Branch, name)
+	}
+
+	b, err := repo.git(append(args, base+`..`+s.Branch)...)
+	if err != nil {
+		return err
+	}
+	changesets := changesetsFromBytes(b)
+	if s.Include != nil || s.Exclude != nil {
+		changesets, err = s.Filter(repo, name, changesets)
+		if err != nil {
+			return err
+		}
+	}
+	s.Changesets = changesets
+	return nil
+}
+
+/* Vanished reports whether the subscribed branch has been removed from its
+ * remote. A remote that cannot be reached is not treated as vanished.
+ */
+func (s *Subscription) Vanished(repo gitRepo) bool {
+	if _, err := repo.git(`rev-parse`, `--verify`, `--quiet`, s.Branch+`^{commit}`); err != nil {
+		return true
+	}
+	parts := strings.SplitN(s.Branch, `/`, 2)
+	if len(parts) != 2 {
+		return false
+	}
+	_, err := repo.git(`ls-remote`, `--exit-code`, `--heads`, parts[0], `refs/heads/`+parts[1])
+	if fc, ok := err.(*FailedCommand); ok {
+		if ee, ok := fc.Err.(*exec.ExitError); ok && ee.ExitCode() == 2 {
+			return true
+		}
+	}
+	return false
+}
+
 const ChangesetGitFormatArg = `--format=%H <%aI!%ae> %s`
 
 /* NewChangeset constructs a new changeset object from a line that matches git format "%H %aI!%ae %s".
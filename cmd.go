@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/comcast/tsb/loadfiles"
 )
@@ -34,6 +35,10 @@ type Executor struct {
 	configRepo string
 	cmds       []string
 	at         string
+	/* engine, if set, is used for builds regardless of configuration. */
+	engine BuildEngine
+	/* cleanups undo the work of the current command if it is cancelled. */
+	cleanups []func()
 }
 
 type Done struct{}
@@ -43,6 +48,12 @@ func (d Done) Error() string { return "Done" }
 func (e *Executor) HasArg() bool {
 	return len(e.cmds) != 0
 }
+func (e *Executor) PeekArg() string {
+	if len(e.cmds) == 0 {
+		return ""
+	}
+	return e.cmds[0]
+}
 func (e *Executor) PopArg() string {
 	if len(e.cmds) == 0 {
 		return ""
@@ -64,232 +75,221 @@ func (e *Executor) Execute() error {
 	if verbose {
 		fmt.Fprintf(os.Stderr, "Performing %s.\n", cmd)
 	}
-	switch cmd {
-	case `fetch`:
-		cfg, err := e.Config(e.at)
-		if err != nil {
-			return err
-		}
+	if run, ok := commands[cmd]; ok {
+		return run(e)
+	}
+	return e.changeDir(cmd)
+}
 
-		return cfg.Repos.Fetch(e.Dir())
-	case `build`, `prebuild`:
-		cfg, err := e.Config(e.at)
-		if err != nil {
-			return err
-		}
+/* commands maps each command to what it does. It is filled in by init,
+ * since commands that take a variable number of arguments look up where the
+ * next command starts in it.
+ */
+var commands map[string]func(e *Executor) error
+
+func init() {
+	commands = map[string]func(e *Executor) error{
+		`fetch`:           (*Executor).Fetch,
+		`build`:           func(e *Executor) error { return e.RunBuild(true) },
+		`prebuild`:        func(e *Executor) error { return e.RunBuild(false) },
+		`update`:          (*Executor).Update,
+		`cherry`:          (*Executor).Cherry,
+		`subscribe`:       (*Executor).Subscribe,
+		`ls-cherry`:       (*Executor).ListPatches,
+		`patch-age`:       (*Executor).PrintPatchAge,
+		`upstream-report`: (*Executor).UpstreamReport,
+		`export-patches`:  (*Executor).ExportPatches,
+		`clean`:           (*Executor).Clean,
+		`bisect`:          (*Executor).Bisect,
+		`bisect-patches`:  (*Executor).BisectPatches,
+		`package`:         (*Executor).Package,
+		`validate`:        (*Executor).Validate,
+		`patchdiff`:       (*Executor).PatchDiff,
+		`diff`:            func(e *Executor) error { return e.Diff(true) },
+		`changelog`:       func(e *Executor) error { return e.Diff(false) },
+		`verbose`:         setVerbose(true),
+		`-v`:              setVerbose(true),
+		`quiet`:           setVerbose(false),
+		`-q`:              setVerbose(false),
+		`dry-run`:         setDryRun,
+		`--dry-run`:       setDryRun,
+		`-n`:              setDryRun,
+		`cd`:              (*Executor).Cd,
+		`at`: func(e *Executor) error {
+			e.at = e.PopArg()
+			return nil
+		},
+	}
+}
 
-		err = cfg.Repos.Prepare(e.Dir())
-		if err != nil {
-			return err
-		}
+/* IsCommand reports whether Execute would take arg as a command, or as a
+ * directory to change to.
+ */
+func (e *Executor) IsCommand(arg string) bool {
+	if _, ok := commands[arg]; ok {
+		return true
+	}
+	_, err := os.Stat(path.Join(e.startDir, arg))
+	return err == nil
+}
 
-		for name, repo := range cfg.Repos {
-			if cfg.Patches[name] != nil {
-				for _, patch_item := range cfg.Patches[name] {
-					chg := patch_item.Change
-					if chg.Node != "" {
-						if repo.BuildStrategy == BuildStrategyMerge {
-							err = repo.Merge(e.Dir(), name, chg.Node)
-						} else { // default to cherry
-							err = repo.Cherry(e.Dir(), name, chg.Node)
-							if verbose {
-								fmt.Fprintf(os.Stderr, "build-strategy for '%s' fallback to 'cherry'.\n", name)
-							}
-						}
-						if err != nil {
-							return fmt.Errorf("Unable to apply %s to %s: "+chg.Node, name, err.Error())
-						}
-					} else if patch_item.Sub != nil {
-						if len(patch_item.Sub.Changesets) > 0 {
-							for _, changeset := range patch_item.Sub.Changesets {
-								if repo.BuildStrategy == BuildStrategyCherry {
-									err = repo.Cherry(e.Dir(), name, changeset.Node)
-								} else if repo.BuildStrategy == BuildStrategyMerge {
-									err = repo.Merge(e.Dir(), name, changeset.Node)
-								} else {
-									return fmt.Errorf("Unrecognized build strategy %s in repo yaml file", repo.BuildStrategy)
-								}
-								if err != nil {
-									return fmt.Errorf("Unable to apply %s to %s: "+changeset.Node, name, err.Error())
-								}
-							}
-						}
-					} else {
-						return errors.New(`Unrecognized format in patches yaml file`)
-					}
-				}
-			}
-		}
+func setVerbose(on bool) func(e *Executor) error {
+	return func(e *Executor) error {
+		verbose = on
+		return nil
+	}
+}
 
-		if cmd == `build` {
-			for _, service := range cfg.Compose.ServiceNames() {
-				b, err := run(`docker`, `compose`, `-f`, path.Join(e.Dir(), `docker-compose.yml`), `build`, `--pull`, `--no-cache`, `--force-rm`, service)
-				if err != nil {
-					return errors.New(`Unable to create build image ` + service + `: ` + err.Error() + "\n" + string(b))
-				}
+func setDryRun(e *Executor) error {
+	dryRun = true
+	return nil
+}
 
-				b, err = run(`docker`, `compose`, `-f`, path.Join(e.Dir(), `docker-compose.yml`), `run`, `--rm`, service)
-				if err != nil {
-					return errors.New(`Failed to build ` + service + `: ` + err.Error() + "\n" + string(b))
-				}
-			}
-		}
+/* Cd isn't generally necessary, but allows the user to explictly use a
+ * directory that matches a command name.
+ */
+func (e *Executor) Cd() error {
+	dir := e.PopArg()
+	if dir == `` {
+		return errors.New(`No argument provided to cd.`)
+	}
+	return e.changeDir(dir)
+}
 
+func (e *Executor) changeDir(dir string) error {
+	_, err := os.Stat(path.Join(e.startDir, dir))
+	if err == nil {
+		e.configRepo = dir
 		return nil
-	case `update`:
-		if e.at != `` {
-			return errors.New("Cannot update from alternate revision.")
-		}
-		cfg, err := e.Config(``)
+	}
+	return errors.New(`Unknown command ` + dir)
+}
+
+func (e *Executor) Fetch() error {
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+
+	return cfg.Repos.Fetch(e.Dir())
+}
+
+/* RunBuild prepares the sources, and builds them if build is set. */
+func (e *Executor) RunBuild(build bool) error {
+	var opts BuildOptions
+	if build {
+		var err error
+		opts, err = e.BuildOptions()
 		if err != nil {
 			return err
 		}
+	}
+
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
 
-		err = cfg.Repos.Update(e.Dir())
+	if opts.Timeout == 0 {
+		options, err := cfg.Compose.Options()
 		if err != nil {
 			return err
 		}
+		opts.Timeout = time.Duration(options.Timeout)
+	}
 
-		for name, _ := range cfg.Patches {
-			g := gitRepo(path.Join(e.Dir(), `src`, name))
-			for sub_ind, patch_item := range cfg.Patches[name] {
-				if patch_item.Sub != nil {
-					b, err := g.git(`log`, `origin/`+cfg.Repos[name].Branch+`..`+patch_item.Sub.Branch, ChangesetGitFormatArg, `--reverse`)
-					if err != nil {
-						return err
-					}
-					cslines := strings.Split(string(bytes.TrimSpace(b)), "\n")
-					changesets := make([]Changeset, len(cslines))
-					for i, csline := range cslines {
-						changesets[i] = NewChangeset(csline)
-					}
-					cfg.Patches[name][sub_ind].Sub.Changesets = changesets
-				}
-			}
-		}
+	restore := withTimeout(opts.Timeout)
+	defer restore()
+	if build {
+		err = e.BuildInWorktree(cfg, opts, true)
+	} else {
+		err = e.Prebuild(cfg, ``)
+	}
+	return e.Cancelled(err, opts.Timeout)
+}
 
-		return e.StoreConfig(cfg)
+func (e *Executor) Cherry() error {
+	arg := e.PopArg()
+	if arg == `` {
+		return errors.New(`No argument provided to cherry.`)
+	}
+	if e.at != `` {
+		return errors.New("Cannot cherry from alternate revision.")
+	}
+	repo, changeset := ParseCherry(arg)
 
-	case `cherry`:
-		arg := e.PopArg()
-		if arg == `` {
-			return errors.New(`No argument provided to cherry.`)
+	cfg, err := e.Config(``)
+	if err != nil {
+		return err
+	}
+	if repo == `` {
+		if len(cfg.Repos) != 1 {
+			return errors.New("You must supply repository to cherry when you do not have exactly one repository.")
 		}
-		if e.at != `` {
-			return errors.New("Cannot cherry from alternate revision.")
+		for repo = range cfg.Repos {
+			/* Just use range to get the only repo name available. */
 		}
-		repo, changeset := ParseCherry(arg)
+	}
 
-		cfg, err := e.Config(``)
+	if _, ok := cfg.Repos[repo]; ok {
+		g := gitRepo(path.Join(e.Dir(), `src`, repo))
+		b, err := g.git(`log`, `-n1`, ChangesetGitFormatArg, changeset)
 		if err != nil {
-			return err
-		}
-		if repo == `` {
-			if len(cfg.Repos) != 1 {
-				return errors.New("You must supply repository to cherry when you do not have exactly one repository.")
-			}
-			for repo = range cfg.Repos {
-				/* Just use range to get the only repo name available. */
-			}
+			return fmt.Errorf(`"%s" is not a valid changeset in "%s": %s`, changeset, repo, err.Error())
 		}
+		changeset = string(bytes.TrimSpace(b)) /* Set changeset to the output, in case a branch head or tag was passed in. */
+	} else {
+		return fmt.Errorf(`"%s" is not a valid repository.`, repo)
+	}
 
-		if _, ok := cfg.Repos[repo]; ok {
-			g := gitRepo(path.Join(e.Dir(), `src`, repo))
-			b, err := g.git(`log`, `-n1`, ChangesetGitFormatArg, changeset)
-			if err != nil {
-				return fmt.Errorf(`"%s" is not a valid changeset in "%s": %s`, changeset, repo, err.Error())
-			}
-			changeset = string(bytes.TrimSpace(b)) /* Set changeset to the output, in case a branch head or tag was passed in. */
-		} else {
-			return fmt.Errorf(`"%s" is not a valid repository.`, repo)
-		}
+	new_patch := new(Patch)
+	new_patch.Change = NewChangeset(changeset)
+
+	cfg.Patches[repo] = append(cfg.Patches[repo], *new_patch)
+	return e.StoreConfig(cfg)
+}
 
-		new_patch := new(Patch)
-		new_patch.Change = NewChangeset(changeset)
+func (e *Executor) Subscribe() error {
+	arg := e.PopArg()
+	if arg == `` {
+		return errors.New(`No argument provided to subscribe`)
+	}
+	if e.at != `` {
+		return errors.New(`Cannot subscribe from alternate revision`)
+	}
+	repo, branch := ParseCherry(arg)
 
-		cfg.Patches[repo] = append(cfg.Patches[repo], *new_patch)
-		return e.StoreConfig(cfg)
+	cfg, err := e.Config(``)
+	if err != nil {
+		return err
+	}
 
-	case `subscribe`:
-		arg := e.PopArg()
-		if arg == `` {
-			return errors.New(`No argument provided to subscribe`)
+	if repo == `` {
+		if len(cfg.Repos) != 1 {
+			return errors.New("You must supply repository to subscribe when you do not have exactly one repository.")
 		}
-		if e.at != `` {
-			return errors.New(`Cannot subscribe from alternate revision`)
+		for repo = range cfg.Repos {
 		}
-		repo, branch := ParseCherry(arg)
+	}
 
-		cfg, err := e.Config(``)
+	if _, ok := cfg.Repos[repo]; ok {
+		g := gitRepo(path.Join(e.Dir(), `src`, repo))
+		all_branches, err := g.git(`branch`, `-a`)
 		if err != nil {
 			return err
 		}
-
-		if repo == `` {
-			if len(cfg.Repos) != 1 {
-				return errors.New("You must supply repository to subscribe when you do not have exactly one repository.")
-			}
-			for repo = range cfg.Repos {
-			}
-		}
-
-		if _, ok := cfg.Repos[repo]; ok {
-			g := gitRepo(path.Join(e.Dir(), `src`, repo))
-			all_branches, err := g.git(`branch`, `-a`)
-			if err != nil {
-				return err
-			}
-			if !strings.Contains(string(all_branches), " remotes/"+string(branch)+"\n") {
-				return fmt.Errorf("%s is not a branch in repository %s", branch, repo)
-			}
-		} else {
-			return fmt.Errorf(`"%s" is not a valid repository.`, repo)
-		}
-		new_sub := new(Subscription)
-		new_sub.Branch = branch
-		new_patch := new(Patch)
-		new_patch.Sub = new_sub
-		cfg.Patches[repo] = append(cfg.Patches[repo], *new_patch)
-		return e.StoreConfig(cfg)
-
-	case `ls-cherry`:
-		return e.ListPatches()
-	case `validate`:
-		return e.Validate()
-	case `patchdiff`:
-		return e.PatchDiff()
-	case `diff`:
-		detailed := true
-		return e.Diff(detailed)
-	case `changelog`:
-		detailed := false
-		return e.Diff(detailed)
-	case `verbose`, `-v`:
-		verbose = true
-		return nil
-	case `quiet`, `-q`:
-		verbose = false
-		return nil
-	case `cd`:
-		/* This isn't generally necessary, but allows the user to
-		 * explictly use a directory that matches a command name.
-		 */
-		cmd = e.PopArg()
-		if cmd == `` {
-			return errors.New(`No argument provided to cd.`)
+		if !strings.Contains(string(all_branches), " remotes/"+string(branch)+"\n") {
+			return fmt.Errorf("%s is not a branch in repository %s", branch, repo)
 		}
-		break
-	case `at`:
-		e.at = e.PopArg()
-		return nil
-	}
-
-	_, err := os.Stat(path.Join(e.startDir, cmd))
-	if err == nil {
-		e.configRepo = cmd
-		return nil
+	} else {
+		return fmt.Errorf(`"%s" is not a valid repository.`, repo)
 	}
-	return errors.New(`Unknown command ` + cmd)
+	new_sub := new(Subscription)
+	new_sub.Branch = branch
+	new_patch := new(Patch)
+	new_patch.Sub = new_sub
+	cfg.Patches[repo] = append(cfg.Patches[repo], *new_patch)
+	return e.StoreConfig(cfg)
 }
 
 func (e *Executor) Dir() string {
@@ -301,35 +301,41 @@ func (e *Executor) Dir() string {
 	return dir
 }
 
+/* ConfigRoot returns the root of the config repository at revision at, or the
+ * working tree if at is empty.
+ */
+func (e *Executor) ConfigRoot(at string) loadfiles.File {
+	if at == `` {
+		return loadfiles.OsFile(e.Dir())
+	}
+	return loadfiles.GitFile{
+		Repo: filepath.Join(e.Dir(), `.git`),
+		Rev:  at,
+	}
+}
+
 func (e *Executor) Config(at string) (*Config, error) {
 	var cfg Config
-	var file loadfiles.File
-	if at == `` {
-		file = loadfiles.OsFile(e.Dir())
-	} else {
-		file = loadfiles.GitFile{
-			Repo: filepath.Join(e.Dir(), `.git`),
-			Rev:  at,
-		}
+	root := e.ConfigRoot(at)
+	err := loadfiles.Load(root, &cfg)
+	if err != nil {
+		return nil, err
 	}
-	err := loadfiles.Load(file, &cfg)
+	cfg.Compose, cfg.ComposeFiles, cfg.ComposeProfiles, err = LoadCompose(root)
 	if err != nil {
 		return nil, err
 	}
 	return &cfg, nil
 }
 
+/* StoreConfig writes the config files; in a dry run, it prints how they
+ * would change instead.
+ */
 func (e *Executor) StoreConfig(cfg *Config) error {
-	return loadfiles.Store(loadfiles.OsFile(e.Dir()), cfg)
-}
-
-func (e *Executor) Validate() error {
-	cfg, err := e.Config(e.at)
-	if err != nil {
-		return err
+	if dryRun {
+		return loadfiles.Store(dryRunFile(e.Dir()), cfg)
 	}
-	fmt.Printf("Valid config: %v\n", *cfg)
-	return nil
+	return loadfiles.Store(loadfiles.OsFile(e.Dir()), cfg)
 }
 
 func ParseCherry(arg string) (string, string) {
@@ -376,9 +382,21 @@ func (e *Executor) ListPatches() error {
 						}
 					}
 				}
+			} else if change_item.File != nil {
+				fmt.Printf("\tPatches in file %s:\n", change_item.File.Path)
+				b, err := change_item.File.Read(e.ConfigRoot(e.at))
+				if err != nil {
+					fmt.Printf("\t\tFailed to read patch file; \"%v\"\n", err)
+				}
+				for _, subject := range PatchSubjects(b) {
+					fmt.Printf("\t\t%s\n", subject)
+				}
 			} else {
 				return errors.New("Unrecognized format in patches yaml")
 			}
+			if u := change_item.UpstreamInfo(); u != nil {
+				fmt.Printf("\t\tUpstream: %s\n", u)
+			}
 		}
 	}
 	return nil
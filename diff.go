@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -111,34 +112,65 @@ func changesetsFor(git gitRepo, hash string) (changesets []Changeset) {
 	return changesets
 }
 
-func patchMapFor(patches []Patch) map[string]Patch {
-	var pmap = make(map[string]Patch)
+// maps patches to changesets; patch files at rev in the config repo are
+// keyed by path and content, and described by their subject lines
+func patchMapFor(git gitRepo, rev string, patches []Patch) map[string]Changeset {
+	var pmap = make(map[string]Changeset)
 	for _, patch := range patches {
-		pmap[patch.Change.Node] = patch
+		if patch.File != nil {
+			var chg Changeset
+			chg.Node = patch.File.Path
+			blob, _ := git.git(`rev-parse`, `--short`, rev+`:`+patch.File.Path)
+			chg.Ref = string(bytes.TrimSpace(blob))
+			mbox, _ := git.git(`show`, rev+`:`+patch.File.Path)
+			chg.Comment = strings.Join(PatchSubjects(mbox), `; `)
+			pmap[chg.Node+`@`+chg.Ref] = chg
+			continue
+		}
+		pmap[patch.Change.Node] = patch.Change
 	}
 	return pmap
 }
 
 func Diff(prevhash string, detailed bool) error {
+	changelogs, err := NewChangelogs(`.`, prevhash, ``)
+	if err != nil {
+		return err
+	}
+	changelogs.PrintMarkdown(detailed)
+	return nil
+}
+
+/* NewChangelogs describes how the config repository in dir, and the
+ * repositories and patches it names, changed from prevhash to head. An
+ * empty head is the index, compared with HEAD; an empty prevhash is the
+ * first parent of head.
+ */
+func NewChangelogs(dir, prevhash, head string) (Changelogs, error) {
 
 	var changelogs Changelogs
 
 	var tsblog Changelog
 	tsblog.Name = `tsb`
 
-	git := gitRepo(`.`)
+	git := gitRepo(dir)
+
+	headrev := head
+	if headrev == `` {
+		headrev = `HEAD`
+	}
 
 	// TSB diffs
-	hashbytes, err := git.git(`rev-parse`, `HEAD`)
+	hashbytes, err := git.git(`rev-parse`, headrev)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tsblog.Head = string(bytes.TrimSpace(hashbytes))
 
 	if prevhash == `` {
-		hashbytes, err := git.git(`rev-parse`, `HEAD^1`)
+		hashbytes, err := git.git(`rev-parse`, headrev+`^1`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		prevhash = string(bytes.TrimSpace(hashbytes))
 	}
@@ -148,16 +180,16 @@ func Diff(prevhash string, detailed bool) error {
 	remotebytes, _ := git.git(`remote`, `get-url`, `origin`)
 	tsblog.Repo = string(bytes.TrimSpace(remotebytes))
 
-	tsbbytes, _ := git.git(`log`, ChangesetGitFormatArg, tsblog.Prev+`..HEAD`)
+	tsbbytes, _ := git.git(`log`, ChangesetGitFormatArg, tsblog.Prev+`..`+headrev)
 	tsblog.CommitsAdded = changesetsFromBytes(tsbbytes)
 
 	changelogs = append(changelogs, tsblog)
 
-	// Parse repos and patches
-	rbyteshead, _ := git.git(`show`, `:repos.yml`)
+	// Parse repos and patches; head names the index if empty
+	rbyteshead, _ := git.git(`show`, head+`:repos.yml`)
 	rbytes, _ := git.git(`show`, tsblog.Prev+`:repos.yml`)
 
-	pbyteshead, _ := git.git(`show`, `:patches.yml`)
+	pbyteshead, _ := git.git(`show`, head+`:patches.yml`)
 	pbytes, _ := git.git(`show`, tsblog.Prev+`:patches.yml`)
 
 	// repository
@@ -172,12 +204,13 @@ func Diff(prevhash string, detailed bool) error {
 	var patches Patches
 	yaml.Unmarshal(pbytes, &patches)
 
+	tsbgit := git
 	for key, repohead := range reposhead {
 
 		var changelog Changelog
 		changelog.Name = key
 
-		git := gitRepo(`src/` + key)
+		git := gitRepo(filepath.Join(dir, `src`, key))
 		remotebytes, _ := git.git(`remote`, `get-url`, `origin`)
 		changelog.Repo = string(bytes.TrimSpace(remotebytes))
 
@@ -230,8 +263,8 @@ func Diff(prevhash string, detailed bool) error {
 		reverse(changesets)
 		changelog.CommitsRemoved = changesets
 
-		pmaphead := patchMapFor(patcheshead[key])
-		pmap := patchMapFor(patches[key])
+		pmaphead := patchMapFor(tsbgit, head, patcheshead[key])
+		pmap := patchMapFor(tsbgit, tsblog.Prev, patches[key])
 
 		if verbose {
 			fmt.Println()
@@ -241,13 +274,13 @@ func Diff(prevhash string, detailed bool) error {
 
 		for key, patch := range pmap {
 			if _, found := pmaphead[key]; !found {
-				changelog.PatchesRemoved = append(changelog.PatchesRemoved, patch.Change)
+				changelog.PatchesRemoved = append(changelog.PatchesRemoved, patch)
 			}
 		}
 
 		for key, patch := range pmaphead {
 			if _, found := pmap[key]; !found {
-				changelog.PatchesAdded = append(changelog.PatchesAdded, patch.Change)
+				changelog.PatchesAdded = append(changelog.PatchesAdded, patch)
 			}
 		}
 
@@ -266,7 +299,5 @@ func Diff(prevhash string, detailed bool) error {
 		changelogs = append(changelogs, changelog)
 	}
 
-	changelogs.PrintMarkdown(detailed)
-
-	return nil
+	return changelogs, nil
 }
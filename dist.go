@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type DistMode string
+
+const (
+	// DistClean empties dist before every build.
+	DistClean = DistMode("clean")
+	// DistPerBuild gives every config commit its own directory in dist,
+	// with dist/latest linking to the last one built.
+	DistPerBuild = DistMode("per-build")
+	// DistKeep leaves dist as it is, so builds may add to it.
+	DistKeep = DistMode("keep")
+	// DistDefault represents an unset mode, which is DistClean.
+	DistDefault = DistMode("")
+)
+
+func (m *DistMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch DistMode(s) {
+	case DistClean, DistPerBuild, DistKeep, DistDefault:
+		*m = DistMode(s)
+		return nil
+	}
+	return errors.New(`unknown dist mode ` + s + `; expected clean, per-build or keep`)
+}
+
+/* DistEnv is set to the directory a build writes its artefacts to, so
+ * that compose files can mount it as ${TSB_DIST:-./dist}.
+ */
+const DistEnv = `TSB_DIST`
+
+/* LatestLink points to the last build in per-build mode. */
+const LatestLink = `latest`
+
+/* DistRoot is the dist directory of the config repository. */
+func (e *Executor) DistRoot() string {
+	return filepath.Join(e.Dir(), `dist`)
+}
+
+/* DistDir returns the directory the build of the config commit writes its
+ * artefacts to.
+ */
+func (e *Executor) DistDir(mode DistMode) (string, error) {
+	if mode != DistPerBuild {
+		return e.DistRoot(), nil
+	}
+	commit, dirty, err := e.configCommit()
+	if err != nil {
+		return ``, errors.New(`The per-build dist mode needs a config commit: ` + err.Error())
+	}
+	name := fmt.Sprintf(`%.12s`, commit)
+	if dirty {
+		name += `-dirty`
+	}
+	return filepath.Join(e.DistRoot(), name), nil
+}
+
+/* prepareDist readies the output directory of a build. */
+func prepareDist(mode DistMode, dir string) error {
+	if mode != DistKeep {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+/* linkLatest points dist/latest at the output directory of a build. */
+func (e *Executor) linkLatest(dir string) error {
+	link := filepath.Join(e.DistRoot(), LatestLink)
+	tmp := link + `.tmp`
+	_ = os.Remove(tmp)
+	err := os.Symlink(filepath.Base(dir), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+/* Clean removes the source checkouts, the build outputs and the images
+ * built for the config repository; or only those named.
+ */
+func (e *Executor) Clean() error {
+	what := make(map[string]bool)
+	for e.HasArg() {
+		arg := e.PeekArg()
+		if arg != `src` && arg != `dist` && arg != `images` {
+			break
+		}
+		what[arg] = true
+		e.PopArg()
+	}
+	if len(what) == 0 {
+		what = map[string]bool{`src`: true, `dist`: true, `images`: true}
+	}
+
+	if what[`images`] {
+		cfg, err := e.Config(e.at)
+		if err != nil {
+			return err
+		}
+		engine, err := e.Engine(cfg, BuildOptions{})
+		if err != nil {
+			return err
+		}
+		project := Project{
+			Dir:     e.Dir(),
+			Files:   cfg.ComposeFiles,
+			Compose: cfg.Compose,
+		}
+		err = engine.Clean(runContext, project)
+		if err != nil {
+			return errors.New(`Unable to remove images: ` + err.Error())
+		}
+	}
+
+	for _, dir := range []string{`dist`, `src`} {
+		if !what[dir] {
+			continue
+		}
+		path := filepath.Join(e.Dir(), dir)
+		if dryRun {
+			fmt.Printf("Would remove %s.\n", path)
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Removing %s.\n", path)
+		}
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
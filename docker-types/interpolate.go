@@ -0,0 +1,198 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InterpolateNode substitutes variables in every scalar value below node, as
+// described by the compose specification. Mapping keys are left as they are.
+func InterpolateNode(node *yaml.Node, lookup func(string) (string, bool)) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := InterpolateNode(child, lookup); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := InterpolateNode(node.Content[i], lookup); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, err := Interpolate(node.Value, lookup)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err.Error())
+		}
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				// Resolve the substituted plain value as the type it looks like
+				node.Tag = ``
+			}
+		}
+	}
+	return nil
+}
+
+// Interpolate substitutes $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error}, ${VAR?error}, ${VAR:+alternate} and ${VAR+alternate} in s.
+// $$ is a literal $.
+func Interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				return ``, fmt.Errorf("unterminated variable in %q", s)
+			}
+			value, err := expand(s[i+2:end], lookup)
+			if err != nil {
+				return ``, err
+			}
+			out.WriteString(value)
+			i = end
+		case isNameStart(next):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			out.WriteString(value)
+			i = j - 1
+		default:
+			out.WriteByte('$')
+		}
+	}
+	return out.String(), nil
+}
+
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || ('0' <= c && c <= '9')
+}
+
+// expand evaluates the inside of a ${...} expression.
+func expand(expr string, lookup func(string) (string, bool)) (string, error) {
+	j := 0
+	for j < len(expr) && isNameChar(expr[j]) {
+		j++
+	}
+	name, op := expr[:j], expr[j:]
+	if name == `` {
+		return ``, fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	value, set := lookup(name)
+	if op == `` {
+		return value, nil
+	}
+
+	colon := strings.HasPrefix(op, `:`)
+	op = strings.TrimPrefix(op, `:`)
+	if op == `` {
+		return ``, fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	// With a colon, an empty value counts as unset
+	present := set && (!colon || value != ``)
+
+	arg, err := Interpolate(op[1:], lookup)
+	if err != nil {
+		return ``, err
+	}
+	switch op[0] {
+	case '-':
+		if present {
+			return value, nil
+		}
+		return arg, nil
+	case '+':
+		if present {
+			return arg, nil
+		}
+		return ``, nil
+	case '?':
+		if present {
+			return value, nil
+		}
+		if arg == `` {
+			arg = `required variable ` + name + ` is missing a value`
+		}
+		return ``, fmt.Errorf("%s", arg)
+	}
+	return ``, fmt.Errorf("invalid variable ${%s}", expr)
+}
+
+// ParseEnvFile parses a .env file of KEY=VALUE lines. Blank lines and lines
+// starting with # are ignored, as is a leading "export ". Values may be
+// single quoted (literal) or double quoted (with escapes); unquoted values
+// end at a " #" comment.
+func ParseEnvFile(b []byte) (map[string]string, error) {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		line = strings.TrimPrefix(line, `export `)
+
+		parts := strings.SplitN(line, `=`, 2)
+		key := strings.TrimSpace(parts[0])
+		if key == `` || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: invalid variable name %q", n, key)
+		}
+		if len(parts) == 1 {
+			env[key] = ``
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && strings.LastIndexByte(value, '\'') > 0:
+			value = value[1:strings.LastIndexByte(value, '\'')]
+		case len(value) >= 2 && value[0] == '"' && strings.LastIndexByte(value, '"') > 0:
+			value = value[1:strings.LastIndexByte(value, '"')]
+			value = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value)
+		default:
+			if i := strings.Index(value, ` #`); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
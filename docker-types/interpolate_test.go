@@ -0,0 +1,125 @@
+package types
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{
+		`FOO`:   `foo`,
+		`EMPTY`: ``,
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{in: `plain`, want: `plain`},
+		{in: `$FOO`, want: `foo`},
+		{in: `${FOO}bar`, want: `foobar`},
+		{in: `$FOO.bar`, want: `foo.bar`},
+		{in: `$UNSET`, want: ``},
+		{in: `${UNSET:-def}`, want: `def`},
+		{in: `${EMPTY:-def}`, want: `def`},
+		{in: `${UNSET-def}`, want: `def`},
+		{in: `${EMPTY-def}`, want: ``},
+		{in: `${FOO:-def}`, want: `foo`},
+		{in: `${FOO:+alt}`, want: `alt`},
+		{in: `${EMPTY:+alt}`, want: ``},
+		{in: `${EMPTY+alt}`, want: `alt`},
+		{in: `${UNSET+alt}`, want: ``},
+		{in: `$$FOO`, want: `$FOO`},
+		{in: `$${FOO}`, want: `${FOO}`},
+		{in: `cost $5`, want: `cost $5`},
+		{in: `end$`, want: `end$`},
+		{in: `${UNSET:-${FOO}}`, want: `foo`},
+		{in: `${UNSET:-a${UNSET2:-b}c}`, want: `abc`},
+		{in: `${FOO:+[${FOO}]}`, want: `[foo]`},
+		{in: `${FOO:?must be set}`, want: `foo`},
+		{in: `${EMPTY?must be set}`, want: ``},
+		{in: `${UNSET:?must be set}`, err: `must be set`},
+		{in: `${EMPTY:?}`, err: `required variable EMPTY is missing a value`},
+		{in: `${UNSET?}`, err: `required variable UNSET is missing a value`},
+		{in: `${UNSET:-${OTHER:?nested}}`, err: `nested`},
+		{in: `${FOO`, err: `unterminated variable`},
+		{in: `${}`, err: `invalid variable`},
+		{in: `${FOO:}`, err: `invalid variable`},
+		{in: `${FOO%x}`, err: `invalid variable`},
+	}
+	for _, test := range tests {
+		got, err := Interpolate(test.in, lookup)
+		if test.err != `` {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Interpolate(%q) = %q, %v; want error %q", test.in, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("Interpolate(%q) = %q, %v; want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{
+			name: `plain`,
+			in:   "# comment\n\nA=1\nexport B=two\n  C = spaced  \nD\n",
+			want: map[string]string{`A`: `1`, `B`: `two`, `C`: `spaced`, `D`: ``},
+		},
+		{
+			name: `comments`,
+			in:   "A=value # comment\nB=a#b\nC=\"quoted # kept\"\n",
+			want: map[string]string{`A`: `value`, `B`: `a#b`, `C`: `quoted # kept`},
+		},
+		{
+			name: `single quotes`,
+			in:   `A='literal $X \n "q"'` + "\n",
+			want: map[string]string{`A`: `literal $X \n "q"`},
+		},
+		{
+			name: `double quotes`,
+			in:   `A="tab\there\nline \"q\" back\\slash"` + "\n",
+			want: map[string]string{`A`: "tab\there\nline \"q\" back\\slash"},
+		},
+		{
+			name: `equals in value`,
+			in:   "A=b=c\nB='x=y'\n",
+			want: map[string]string{`A`: `b=c`, `B`: `x=y`},
+		},
+		{
+			name: `invalid name`,
+			in:   "BAD KEY=1\n",
+			err:  true,
+		},
+		{
+			name: `empty name`,
+			in:   "=1\n",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseEnvFile([]byte(test.in))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: ParseEnvFile = %v; want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: ParseEnvFile = %v, %v; want %v", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package types
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// replacedSequences are the sequences an override file replaces outright
+// rather than extending.
+var replacedSequences = map[string]bool{
+	"command":    true,
+	"entrypoint": true,
+	"test":       true,
+}
+
+// mountSequences are the sequences whose entries are merged by their target
+// path inside the container.
+var mountSequences = map[string]bool{
+	"devices": true,
+	"tmpfs":   true,
+	"volumes": true,
+}
+
+// MergeNodes merges the override compose document into base, following the
+// merge rules of the compose specification: mappings are merged key by key,
+// most sequences are extended, mounts are merged by target, and scalars
+// (or values of differing kinds) are replaced. The merged node is returned.
+func MergeNodes(base, override *yaml.Node) *yaml.Node {
+	return mergeNode(``, base, override)
+}
+
+func mergeNode(key string, base, override *yaml.Node) *yaml.Node {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	if base.Kind == yaml.DocumentNode && override.Kind == yaml.DocumentNode {
+		if len(base.Content) == 0 {
+			return override
+		}
+		if len(override.Content) > 0 {
+			base.Content[0] = mergeNode(key, base.Content[0], override.Content[0])
+		}
+		return base
+	}
+	if base.Kind != override.Kind {
+		return override
+	}
+
+	switch base.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			k, v := override.Content[i], override.Content[i+1]
+			found := false
+			for j := 0; j+1 < len(base.Content); j += 2 {
+				if base.Content[j].Value == k.Value {
+					base.Content[j+1] = mergeNode(k.Value, base.Content[j+1], v)
+					found = true
+					break
+				}
+			}
+			if !found {
+				base.Content = append(base.Content, k, v)
+			}
+		}
+		return base
+	case yaml.SequenceNode:
+		if replacedSequences[key] {
+			return override
+		}
+		for _, item := range override.Content {
+			base.Content = mergeSequenceItem(key, base.Content, item)
+		}
+		return base
+	}
+	return override
+}
+
+// mergeSequenceItem adds item to a sequence, replacing an existing entry for
+// the same mount target, and skipping duplicate scalars.
+func mergeSequenceItem(key string, items []*yaml.Node, item *yaml.Node) []*yaml.Node {
+	for i, existing := range items {
+		if mountSequences[key] {
+			if target := mountTarget(item); target != `` && target == mountTarget(existing) {
+				items[i] = item
+				return items
+			}
+		} else if existing.Kind == yaml.ScalarNode && item.Kind == yaml.ScalarNode && existing.Value == item.Value {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// mountTarget returns the path inside the container of a volume, device or
+// tmpfs entry, in either its short or long syntax.
+func mountTarget(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		parts := strings.Split(node.Value, `:`)
+		if len(parts) == 1 {
+			return parts[0]
+		}
+		return parts[1]
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == `target` {
+				return node.Content[i+1].Value
+			}
+		}
+	}
+	return ``
+}
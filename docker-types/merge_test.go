@@ -0,0 +1,156 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		override string
+		want     string
+	}{
+		{
+			name: `volumes by target`,
+			base: `
+services:
+  app:
+    volumes:
+      - ./src:/src
+      - ./dist:/dist:rw
+      - type: bind
+        source: ./cache
+        target: /cache
+      - /anonymous
+`,
+			override: `
+services:
+  app:
+    volumes:
+      - ./other:/dist
+      - type: bind
+        source: ./cache2
+        target: /cache
+      - ./extra:/extra
+      - /anonymous
+`,
+			want: `
+services:
+  app:
+    volumes:
+      - ./src:/src
+      - ./other:/dist
+      - type: bind
+        source: ./cache2
+        target: /cache
+      - /anonymous
+      - ./extra:/extra
+`,
+		},
+		{
+			name: `command and entrypoint replaced`,
+			base: `
+services:
+  app:
+    entrypoint: [/bin/sh, -c]
+    command: [make, all]
+    healthcheck:
+      test: [CMD, true]
+`,
+			override: `
+services:
+  app:
+    command: [make, check]
+    healthcheck:
+      test: [CMD, false]
+`,
+			want: `
+services:
+  app:
+    entrypoint: [/bin/sh, -c]
+    command: [make, check]
+    healthcheck:
+      test: [CMD, false]
+`,
+		},
+		{
+			name: `command of another form`,
+			base: `
+services:
+  app:
+    command: [make, all]
+`,
+			override: `
+services:
+  app:
+    command: make check
+`,
+			want: `
+services:
+  app:
+    command: make check
+`,
+		},
+		{
+			name: `mappings merged and sequences extended`,
+			base: `
+services:
+  app:
+    image: base
+    ports: ["80"]
+    environment:
+      A: "1"
+      B: "2"
+x-tsb:
+  engine: docker compose
+`,
+			override: `
+services:
+  app:
+    image: override
+    ports: ["80", "443"]
+    environment:
+      B: "3"
+  new:
+    image: new
+`,
+			want: `
+services:
+  app:
+    image: override
+    ports: ["80", "443"]
+    environment:
+      A: "1"
+      B: "3"
+  new:
+    image: new
+x-tsb:
+  engine: docker compose
+`,
+		},
+	}
+	for _, test := range tests {
+		var base, override yaml.Node
+		if err := yaml.Unmarshal([]byte(test.base), &base); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := yaml.Unmarshal([]byte(test.override), &override); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var got, want interface{}
+		if err := MergeNodes(&base, &override).Decode(&got); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := yaml.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: MergeNodes = %v; want %v", test.name, got, want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 func (c *Services) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	serviceMap := map[string]ServiceConfig{}
@@ -59,3 +62,139 @@ func (svc ServiceVolumeConfig) MarshalYAML() (interface{}, error) {
 	}
 	return _ServiceVolumeConfig(svc), nil
 }
+
+type _BuildConfig BuildConfig
+
+// UnmarshalYAML accepts the short form of build, which is just the context
+func (b *BuildConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var context string
+	if err := unmarshal(&context); err == nil {
+		*b = BuildConfig{Context: context}
+		return nil
+	}
+	return unmarshal((*_BuildConfig)(b))
+}
+
+// MountsDist reports whether the service mounts the dist directory, or a
+// directory within it
+func (s ServiceConfig) MountsDist() bool {
+	for _, vol := range s.Volumes {
+		source := strings.TrimPrefix(vol.Source, `./`)
+		if source == `dist` || strings.HasPrefix(source, `dist/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// MountsSrc reports whether the service mounts the src directory of the
+// config repository, or a directory within it, by its relative path
+func (s ServiceConfig) MountsSrc() bool {
+	for _, vol := range s.Volumes {
+		source := strings.TrimPrefix(vol.Source, `./`)
+		if source == `src` || strings.HasPrefix(source, `src/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalYAML accepts a command as a string, split into words as a shell
+// would, or as a list of arguments
+func (c *ShellCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err == nil {
+		*c = SplitCommand(line)
+		return nil
+	}
+	return unmarshal((*[]string)(c))
+}
+
+// SplitCommand splits a command line into words, honouring single and double
+// quotes and backslash escapes
+func SplitCommand(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(line) && quote != '\'':
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// UnmarshalYAML accepts a single string as a list of one
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+// UnmarshalYAML accepts both the mapping and the key[=value] list forms
+func (m *MappingWithEquals) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*m = make(MappingWithEquals)
+		for _, item := range list {
+			parts := strings.SplitN(item, `=`, 2)
+			if len(parts) == 1 {
+				(*m)[parts[0]] = nil
+			} else {
+				value := parts[1]
+				(*m)[parts[0]] = &value
+			}
+		}
+		return nil
+	}
+	return unmarshal((*map[string]*string)(m))
+}
+
+// UnmarshalYAML accepts a duration such as 1m30s
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
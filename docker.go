@@ -17,11 +17,24 @@ limitations under the License.
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/comcast/tsb/docker-types"
+	"github.com/comcast/tsb/loadfiles"
+	"gopkg.in/yaml.v3"
 )
 
+/* ComposeFile is the compose file in the config repository. */
+const ComposeFile = `docker-compose.yml`
+
+/* EnvFile holds default values for variables used in the compose file. */
+const EnvFile = `.env`
+
 type Compose types.Config
 
 func (c Compose) ServiceNames() []string {
@@ -32,3 +45,294 @@ func (c Compose) ServiceNames() []string {
 	sort.Strings(names)
 	return names
 }
+
+/* ComposeIssue is a problem with a compose file feature. */
+type ComposeIssue struct {
+	/* Service is the service at fault, or empty for the top level. */
+	Service string
+	Key     string
+	Msg     string
+	/* Fatal issues prevent a build; the others are warnings. */
+	Fatal bool
+}
+
+func (i ComposeIssue) String() string {
+	s := i.Msg
+	if i.Key != `` {
+		s = i.Key + `: ` + s
+	}
+	if i.Service != `` {
+		s = `service ` + i.Service + `: ` + s
+	}
+	return s
+}
+
+/* composeTopLevelKeys are the top-level properties of the compose
+ * specification.
+ */
+var composeTopLevelKeys = map[string]bool{
+	`version`:  true,
+	`name`:     true,
+	`include`:  true,
+	`services`: true,
+	`networks`: true,
+	`volumes`:  true,
+	`configs`:  true,
+	`secrets`:  true,
+}
+
+/* Issues reports forbidden and deprecated properties and invalid x-tsb
+ * settings. If host, the services are built by the host engine, and those
+ * without a command to run are reported; otherwise those that have neither
+ * an image nor a build or do not mount a dist directory are.
+ */
+func (c Compose) Issues(host bool) []ComposeIssue {
+	var issues []ComposeIssue
+
+	var keys []string
+	for key := range c.Extras {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch {
+		case key == `include`:
+			issues = append(issues, ComposeIssue{Key: key, Msg: `Included files are not merged; list them in COMPOSE_FILE instead.`})
+		case !composeTopLevelKeys[key] && !strings.HasPrefix(key, `x-`):
+			issues = append(issues, ComposeIssue{Key: key, Msg: `Unknown top-level property.`})
+		}
+	}
+
+	for _, name := range c.ServiceNames() {
+		svc := c.Service(name)
+
+		var present []string
+		for key := range svc.Extras {
+			present = append(present, key)
+		}
+		if svc.ContainerName != `` {
+			present = append(present, `container_name`)
+		}
+		if len(svc.Expose) > 0 {
+			present = append(present, `expose`)
+		}
+		sort.Strings(present)
+		/* types.UnsupportedProperties are those a swarm stack cannot
+		 * deploy. Compose engines support them, build included, and the
+		 * host engine runs no containers, so they are not reported.
+		 */
+		for _, key := range present {
+			if msg, ok := types.ForbiddenProperties[key]; ok {
+				issues = append(issues, ComposeIssue{Service: name, Key: key, Msg: msg, Fatal: true})
+			} else if msg, ok := types.DeprecatedProperties[key]; ok {
+				issues = append(issues, ComposeIssue{Service: name, Key: key, Msg: msg})
+			}
+		}
+
+		var opts ServiceOptions
+		if err := decodeExtension(svc.Extras[OptionsKey], &opts); err != nil {
+			issues = append(issues, ComposeIssue{Service: name, Key: OptionsKey, Msg: `Invalid settings: ` + err.Error(), Fatal: true})
+		}
+		for _, pattern := range opts.Artefacts {
+			if _, err := filepath.Match(pattern, ``); err != nil {
+				issues = append(issues, ComposeIssue{Service: name, Key: OptionsKey, Msg: `Invalid artefact pattern ` + pattern + `.`, Fatal: true})
+			}
+		}
+		if host {
+			if len(opts.Command) == 0 && len(svc.Entrypoint) == 0 && len(svc.Command) == 0 {
+				issues = append(issues, ComposeIssue{Service: name, Msg: `No command to run on the host; set command in its ` + OptionsKey + ` extension.`, Fatal: true})
+			}
+			continue
+		}
+
+		if svc.Image == `` && svc.Build.Context == `` && svc.Build.Dockerfile == `` {
+			issues = append(issues, ComposeIssue{Service: name, Msg: `Neither image nor build is set.`, Fatal: true})
+		}
+
+		if !svc.MountsDist() {
+			issues = append(issues, ComposeIssue{Service: name, Msg: `No dist directory is mounted, so the build cannot produce artefacts.`})
+		}
+	}
+	return issues
+}
+
+/* Service returns the named service. */
+func (c Compose) Service(name string) *types.ServiceConfig {
+	for i := range c.Services {
+		if c.Services[i].Name == name {
+			return &c.Services[i]
+		}
+	}
+	return nil
+}
+
+/* ComposeEnv returns the environment used to interpolate the compose file:
+ * the variables of the .env file in the config repository, if there is one,
+ * overridden by those of the process environment.
+ */
+func ComposeEnv(root loadfiles.File) (types.ConfigDetails, error) {
+	details := types.ConfigDetails{Environment: make(map[string]string)}
+
+	f, err := root.In(EnvFile).Open()
+	if err == nil {
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return details, errors.New(`Unable to read ` + EnvFile + `: ` + err.Error())
+		}
+		details.Environment, err = types.ParseEnvFile(b)
+		if err != nil {
+			return details, errors.New(`Invalid ` + EnvFile + `: ` + err.Error())
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, `=`, 2)
+		if len(parts) == 2 {
+			details.Environment[parts[0]] = parts[1]
+		}
+	}
+	return details, nil
+}
+
+/* ComposeFiles returns the compose files to merge, in order: those listed
+ * in COMPOSE_FILE, or just docker-compose.yml.
+ */
+func ComposeFiles(env types.ConfigDetails) []string {
+	value, _ := env.LookupEnv(`COMPOSE_FILE`)
+	sep, _ := env.LookupEnv(`COMPOSE_PATH_SEPARATOR`)
+	if sep == `` {
+		sep = string(os.PathListSeparator)
+	}
+	files := splitList(value, sep)
+	if len(files) == 0 {
+		return []string{ComposeFile}
+	}
+	return files
+}
+
+/* ComposeProfiles returns the profiles enabled by COMPOSE_PROFILES. */
+func ComposeProfiles(env types.ConfigDetails) []string {
+	value, _ := env.LookupEnv(`COMPOSE_PROFILES`)
+	return splitList(value, `,`)
+}
+
+func splitList(value, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != `` {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/* composeSource is the merged compose files of a config repository. */
+type composeSource struct {
+	Env   types.ConfigDetails
+	Files []string
+	/* Root is the merged document node. */
+	Root *yaml.Node
+	/* Origins maps each node to the file it came from. */
+	Origins map[*yaml.Node]string
+}
+
+func recordOrigin(origins map[*yaml.Node]string, node *yaml.Node, file string) {
+	origins[node] = file
+	for _, child := range node.Content {
+		recordOrigin(origins, child, file)
+	}
+}
+
+/* loadComposeSource reads the compose files, interpolates variables in each,
+ * and merges them in order.
+ */
+func loadComposeSource(root loadfiles.File) (*composeSource, error) {
+	env, err := ComposeEnv(root)
+	if err != nil {
+		return nil, err
+	}
+	src := &composeSource{
+		Env:     env,
+		Files:   ComposeFiles(env),
+		Origins: make(map[*yaml.Node]string),
+	}
+
+	for _, name := range src.Files {
+		file := root.In(name)
+		f, err := file.Open()
+		if err != nil {
+			return nil, errors.New(`Unable to open file ` + file.String() + `: ` + err.Error())
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New(`Unable to read file ` + file.String() + `: ` + err.Error())
+		}
+
+		var node yaml.Node
+		err = yaml.Unmarshal(b, &node)
+		if err != nil {
+			return nil, errors.New(name + `: ` + err.Error())
+		}
+		err = types.InterpolateNode(&node, env.LookupEnv)
+		if err != nil {
+			return nil, errors.New(`Unable to interpolate ` + name + `: ` + err.Error())
+		}
+
+		recordOrigin(src.Origins, &node, name)
+		src.Root = types.MergeNodes(src.Root, &node)
+	}
+	return src, nil
+}
+
+/* Decode returns the merged compose file. */
+func (src *composeSource) Decode() (Compose, error) {
+	var compose Compose
+	if src.Root == nil || len(src.Root.Content) == 0 {
+		return compose, nil
+	}
+	err := src.Root.Decode(&compose)
+	return compose, err
+}
+
+/* LoadCompose reads and merges the compose files of the config repository,
+ * with variables substituted from the environment and the .env file. It
+ * returns the files it merged and the profiles enabled by default.
+ */
+func LoadCompose(root loadfiles.File) (Compose, []string, []string, error) {
+	src, err := loadComposeSource(root)
+	if err != nil {
+		return Compose{}, nil, nil, err
+	}
+	compose, err := src.Decode()
+	return compose, src.Files, ComposeProfiles(src.Env), err
+}
+
+/* Enabled reports whether a service runs with the given profiles: services
+ * without profiles always do.
+ */
+func Enabled(svc *types.ServiceConfig, profiles []string) bool {
+	if len(svc.Profiles) == 0 {
+		return true
+	}
+	for _, p := range svc.Profiles {
+		for _, enabled := range profiles {
+			if p == enabled || enabled == `*` {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* EnabledServiceNames returns the services that run with the given profiles. */
+func (c Compose) EnabledServiceNames(profiles []string) []string {
+	var names []string
+	for _, name := range c.ServiceNames() {
+		if Enabled(c.Service(name), profiles) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
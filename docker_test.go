@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/comcast/tsb/loadfiles"
+)
+
+func TestComposeTopLevelIssues(t *testing.T) {
+	compose := `
+version: "3"
+name: product
+include:
+  - other.yml
+x-common: &common
+  image: base
+services:
+  base:
+    <<: *common
+    volumes:
+      - ./dist:/dist
+networks: {}
+volumes: {}
+configs: {}
+secrets: {}
+unknown: true
+`
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ComposeFile), []byte(compose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, _, _, err := LoadCompose(loadfiles.OsFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, issue := range c.Issues(false) {
+		if issue.Service == `` {
+			keys = append(keys, issue.Key)
+		}
+	}
+	if want := []string{`include`, `unknown`}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("top-level issues %v; want %v", keys, want)
+	}
+}
+
+func TestComposeHostIssues(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  container:
+    image: builder
+    volumes:
+      - ./dist:/dist
+  hosted:
+    x-tsb:
+      command: [make, dist]
+  entrypoint:
+    entrypoint: [make]
+  nothing:
+    environment:
+      A: b
+`
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ComposeFile), []byte(compose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, _, _, err := LoadCompose(loadfiles.OsFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		host bool
+		want []string
+	}{
+		{false, []string{`entrypoint`, `entrypoint`, `hosted`, `hosted`, `nothing`, `nothing`}},
+		{true, []string{`container`, `nothing`}},
+	} {
+		var services []string
+		for _, issue := range c.Issues(test.host) {
+			services = append(services, issue.Service)
+		}
+		sort.Strings(services)
+		if !reflect.DeepEqual(services, test.want) {
+			t.Errorf("host %v: issues of services %v; want %v", test.host, services, test.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/comcast/tsb/loadfiles"
+)
+
+/* dryRun shows what commands would change rather than changing it: the
+ * commands that would modify repositories or run builds are printed rather
+ * than run, and config files are diffed rather than written.
+ */
+var dryRun bool
+
+/* readOnlyGit are the git commands a dry run still runs, since what they
+ * report decides what happens next.
+ */
+var readOnlyGit = map[string]bool{
+	`cat-file`:     true,
+	`describe`:     true,
+	`diff`:         true,
+	`for-each-ref`: true,
+	`log`:          true,
+	`ls-remote`:    true,
+	`merge-base`:   true,
+	`rev-list`:     true,
+	`rev-parse`:    true,
+	`show`:         true,
+	`status`:       true,
+	`version`:      true,
+}
+
+/* readOnlyEngine are the container engine commands a dry run still runs. */
+var readOnlyEngine = map[string]bool{
+	`config`:  true,
+	`images`:  true,
+	`info`:    true,
+	`inspect`: true,
+	`ls`:      true,
+	`ps`:      true,
+	`version`: true,
+}
+
+/* engineFlagArgs are the container engine options that take an argument. */
+var engineFlagArgs = map[string]bool{
+	`-f`:             true,
+	`--file`:         true,
+	`-p`:             true,
+	`--project-name`: true,
+	`--profile`:      true,
+	`--env-file`:     true,
+}
+
+/* branchListArgs are the options of git branch that list branches and take
+ * an argument.
+ */
+var branchListArgs = map[string]bool{
+	`--contains`:    true,
+	`--no-contains`: true,
+	`--merged`:      true,
+	`--no-merged`:   true,
+	`--points-at`:   true,
+}
+
+/* readOnly reports whether a command only inspects, so that a dry run may
+ * run it.
+ */
+func readOnly(cmd string, args []string) bool {
+	var words []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case cmd == `git` && (arg == `-C` || arg == `-c`):
+			i++
+		case engineFlagArgs[arg] && cmd != `git`:
+			i++
+		case strings.HasPrefix(arg, `-`):
+			if len(words) > 0 {
+				words = append(words, arg)
+			}
+		default:
+			words = append(words, arg)
+		}
+	}
+	if len(words) == 0 {
+		return false
+	}
+
+	if cmd != `git` {
+		for _, word := range words {
+			if word == `compose` || word == `image` || word == `container` {
+				continue
+			}
+			return readOnlyEngine[word]
+		}
+		return false
+	}
+
+	rest := words[1:]
+	switch words[0] {
+	case `branch`:
+		for i := 0; i < len(rest); i++ {
+			arg := rest[i]
+			if branchListArgs[arg] {
+				/* Its argument is a commit, not a branch to create. */
+				i++
+			} else if !strings.HasPrefix(arg, `-`) || arg == `-d` || arg == `-D` || arg == `-m` || arg == `-M` || arg == `-f` {
+				return false
+			}
+		}
+		return true
+	case `remote`:
+		return len(rest) == 0 || rest[0] == `get-url` || rest[0] == `show` || rest[0] == `-v`
+	case `config`:
+		return len(rest) > 0 && strings.HasPrefix(rest[0], `--get`)
+	case `worktree`:
+		return len(rest) > 0 && rest[0] == `list`
+	case `format-patch`:
+		for _, arg := range rest {
+			if arg == `--stdout` {
+				return true
+			}
+		}
+		return false
+	}
+	return readOnlyGit[words[0]]
+}
+
+/* recordCommand prints a command that a dry run does not run. */
+func recordCommand(dir, cmd string, args []string) {
+	words := []string{quoteArg(cmd)}
+	for _, arg := range args {
+		words = append(words, quoteArg(arg))
+	}
+	if dir != `` {
+		fmt.Printf("Would run in %s: %s\n", dir, strings.Join(words, ` `))
+	} else {
+		fmt.Printf("Would run: %s\n", strings.Join(words, ` `))
+	}
+}
+
+/* quoteArg quotes an argument for a shell, if it needs it. */
+func quoteArg(arg string) string {
+	if arg != `` && !strings.ContainsAny(arg, " \t\n'\"\\$`|&;<>()*?[]#~{}") {
+		return arg
+	}
+	return `'` + strings.Replace(arg, `'`, `'\''`, -1) + `'`
+}
+
+/* dryRunFile is a config file that a dry run shows the changes to, rather
+ * than writing.
+ */
+type dryRunFile string
+
+func (f dryRunFile) Open() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+func (f dryRunFile) Create() (io.WriteCloser, error) {
+	return &dryRunWriter{file: string(f)}, nil
+}
+
+func (f dryRunFile) In(filename string) loadfiles.File {
+	return dryRunFile(filepath.Join(string(f), filename))
+}
+
+func (f dryRunFile) String() string {
+	return string(f)
+}
+
+/* dryRunWriter prints, when closed, the difference between what was
+ * written and the file.
+ */
+type dryRunWriter struct {
+	file string
+	bytes.Buffer
+}
+
+func (w *dryRunWriter) Close() error {
+	old, err := ioutil.ReadFile(w.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	name := filepath.Base(w.file)
+	fmt.Print(unifiedDiff(`a/`+name, `b/`+name, string(old), w.String()))
+	return nil
+}
+
+/* unifiedDiff returns the differences between two texts, by line, in the
+ * unified format with three lines of context; or nothing if they are the
+ * same.
+ */
+func unifiedDiff(oldName, newName, old, new string) string {
+	a, b := splitLines(old), splitLines(new)
+
+	/* lcs[i][j] is the length of the longest common subsequence of a[i:]
+	 * and b[j:].
+	 */
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		/* A hunk runs until the changes are more than twice the context
+		 * apart.
+		 */
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		end := start
+		for k := start; k < len(lines); k++ {
+			if lines[k].op != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		last := end + context
+		if last >= len(lines) {
+			last = len(lines) - 1
+		}
+
+		oldStart, newStart := 1, 1
+		for _, l := range lines[:first] {
+			if l.op != '+' {
+				oldStart++
+			}
+			if l.op != '-' {
+				newStart++
+			}
+		}
+		oldLen, newLen := 0, 0
+		for _, l := range lines[first : last+1] {
+			if l.op != '+' {
+				oldLen++
+			}
+			if l.op != '-' {
+				newLen++
+			}
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		if oldLen == 0 {
+			oldStart--
+		}
+		if newLen == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLen), hunkRange(newStart, newLen))
+		for _, l := range lines[first : last+1] {
+			fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		}
+		start = last + 1
+	}
+	return out.String()
+}
+
+/* hunkRange is the range of lines of a hunk header, which leaves out a
+ * length of one, as diff -u does.
+ */
+func hunkRange(start, length int) string {
+	if length == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+func splitLines(s string) []string {
+	if s == `` {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	for _, test := range []struct {
+		cmd  string
+		args string
+		want bool
+	}{
+		{`git`, `log --format=%H`, true},
+		{`git`, `-C src/up rev-parse HEAD`, true},
+		{`git`, `-c core.quotepath=off diff HEAD`, true},
+		{`git`, `fetch origin`, false},
+		{`git`, `checkout -f HEAD`, false},
+
+		{`git`, `branch`, true},
+		{`git`, `branch --list`, true},
+		{`git`, `branch -a --contains HEAD`, true},
+		{`git`, `branch topic`, false},
+		{`git`, `branch -f topic HEAD`, false},
+		{`git`, `branch -D topic`, false},
+		{`git`, `-C src/up branch -m old new`, false},
+
+		{`git`, `worktree list`, true},
+		{`git`, `worktree list --porcelain`, true},
+		{`git`, `worktree`, false},
+		{`git`, `worktree add --detach src/.worktrees/build HEAD`, false},
+		{`git`, `worktree remove --force src/.worktrees/build`, false},
+		{`git`, `worktree prune`, false},
+
+		{`git`, `remote`, true},
+		{`git`, `remote -v`, true},
+		{`git`, `remote get-url origin`, true},
+		{`git`, `remote show origin`, true},
+		{`git`, `remote add upstream https://example.com/up.git`, false},
+		{`git`, `remote set-url origin https://example.com/up.git`, false},
+		{`git`, `remote remove upstream`, false},
+
+		{`git`, `config --get remote.origin.url`, true},
+		{`git`, `config --get-regexp ^remote\.`, true},
+		{`git`, `config`, false},
+		{`git`, `config user.name tsb`, false},
+		{`git`, `config --unset user.name`, false},
+
+		{`git`, `format-patch --stdout HEAD^..HEAD`, true},
+		{`git`, `format-patch -o patches HEAD^..HEAD`, false},
+
+		{`docker`, `compose -f docker-compose.yml -p tsb config`, true},
+		{`docker`, `compose --profile docs ps`, true},
+		{`docker`, `compose -f docker-compose.yml -p tsb down`, false},
+		{`docker`, `compose -p tsb build --pull base`, false},
+		{`docker-compose`, `--env-file .env -p tsb down --rmi local`, false},
+		{`docker-compose`, `-p tsb run --rm base`, false},
+		{`docker`, `image inspect base`, true},
+		{`docker`, `images`, true},
+		{`docker`, `image rm base`, false},
+		{`docker`, `rmi base`, false},
+		{`podman`, `container ls`, true},
+		{`podman`, `container rm -f base`, false},
+		{`docker`, `info`, true},
+		{`docker`, ``, false},
+	} {
+		args := strings.Fields(test.args)
+		if got := readOnly(test.cmd, args); got != test.want {
+			t.Errorf("readOnly(%s %s) = %v; want %v", test.cmd, test.args, got, test.want)
+		}
+	}
+}
+
+/* numbered is the numbers from 1 to n, one per line, with those in changes
+ * replaced.
+ */
+func numbered(n int, changes map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := changes[i]; ok {
+			b.WriteString(line + "\n")
+		} else {
+			b.WriteString(strconv.Itoa(i) + "\n")
+		}
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{`same`, numbered(5, nil), numbered(5, nil), ``},
+		{
+			`first line`, numbered(7, nil), numbered(7, map[int]string{1: `one`}),
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n",
+		},
+		{
+			`last line`, numbered(7, nil), numbered(7, map[int]string{7: `seven`}),
+			"@@ -4,4 +4,4 @@\n 4\n 5\n 6\n-7\n+seven\n",
+		},
+		{
+			`inserted at start`, "2\n3\n", "1\n2\n3\n",
+			"@@ -1,2 +1,3 @@\n+1\n 2\n 3\n",
+		},
+		{
+			`appended`, "1\n2\n", "1\n2\n3\n",
+			"@@ -1,2 +1,3 @@\n 1\n 2\n+3\n",
+		},
+		{
+			`deleted at end`, numbered(6, nil), numbered(4, nil),
+			"@@ -2,5 +2,3 @@\n 2\n 3\n 4\n-5\n-6\n",
+		},
+		{`created`, ``, "1\n", "@@ -0,0 +1 @@\n+1\n"},
+		{`emptied`, "1\n", ``, "@@ -1 +0,0 @@\n-1\n"},
+		{
+			`joined hunks`, numbered(20, nil), numbered(20, map[int]string{2: `two`, 9: `nine`}),
+			"@@ -1,12 +1,12 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+nine\n 10\n 11\n 12\n",
+		},
+		{
+			`separate hunks`, numbered(20, nil), numbered(20, map[int]string{2: `two`, 10: `ten`}),
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -7,7 +7,7 @@\n 7\n 8\n 9\n-10\n+ten\n 11\n 12\n 13\n",
+		},
+		{
+			`first and last lines`, numbered(20, nil), numbered(20, map[int]string{1: `one`, 20: `twenty`}),
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -17,4 +17,4 @@\n 17\n 18\n 19\n-20\n+twenty\n",
+		},
+	} {
+		want := test.want
+		if want != `` {
+			want = "--- a/x\n+++ b/x\n" + want
+		}
+		if got := unifiedDiff(`a/x`, `b/x`, test.old, test.new); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
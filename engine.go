@@ -0,0 +1,629 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/* Project is what an engine needs to know to build the compose services. */
+type Project struct {
+	/* Dir is the config repository. */
+	Dir      string
+	Files    []string
+	Profiles []string
+	Compose  Compose
+	/* NoCache builds images without using cached layers. */
+	NoCache bool
+	/* Src holds the checkouts of the repositories being built. */
+	Src string
+	/* Dist is the directory the build writes its artefacts to. */
+	Dist string
+}
+
+/* Path resolves a path relative to the config repository. */
+func (p Project) Path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(p.Dir, file)
+}
+
+/* ServiceOptions returns the x-tsb settings of a service. */
+func (p Project) ServiceOptions(service string) (ServiceOptions, error) {
+	svc := p.Compose.Service(service)
+	if svc == nil {
+		return ServiceOptions{}, errors.New(`No service ` + service + `.`)
+	}
+	return ServiceOptionsOf(svc)
+}
+
+/* BuildEngine builds and runs compose services. */
+type BuildEngine interface {
+	Name() string
+	/* Available reports whether the engine can be used on this host. */
+	Available() bool
+	/* BuildImage creates the image a service runs in. */
+	BuildImage(ctx context.Context, p Project, service string) error
+	/* RunService runs a service to completion. */
+	RunService(ctx context.Context, p Project, service string) error
+	/* Stop stops and removes any containers left running by a cancelled
+	 * build.
+	 */
+	Stop(ctx context.Context, p Project) error
+	/* Clean removes the images built for the services. */
+	Clean(ctx context.Context, p Project) error
+}
+
+/* Engines are the container engines, in the order auto-detection tries them. */
+var Engines = []BuildEngine{
+	ComposeEngine{`docker`, `compose`},
+	ComposeEngine{`docker-compose`},
+	ComposeEngine{`podman`, `compose`},
+	ComposeEngine{`podman-compose`},
+	PodmanEngine{},
+	ComposeEngine{`nerdctl`, `compose`},
+}
+
+/* EngineAuto selects the first available engine. */
+const EngineAuto = `auto`
+
+/* FindEngine returns the named engine, or the first available one for auto
+ * or an empty name.
+ */
+func FindEngine(name string) (BuildEngine, error) {
+	if name == `` || name == EngineAuto {
+		for _, engine := range Engines {
+			if engine.Available() {
+				return engine, nil
+			}
+		}
+		return nil, errors.New(`No container engine found; install docker or podman, or choose an engine.`)
+	}
+
+	switch name {
+	case `host`:
+		return HostEngine{}, nil
+	}
+	var names []string
+	for _, engine := range Engines {
+		if engine.Name() == name {
+			return engine, nil
+		}
+		names = append(names, engine.Name())
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Unknown engine %s; expected one of %s, host or %s.", name, strings.Join(names, `, `), EngineAuto)
+}
+
+/* ComposeEngine drives a compose implementation, such as `docker compose`
+ * or `docker-compose`.
+ */
+type ComposeEngine []string
+
+func (c ComposeEngine) Name() string {
+	return strings.Join(c, ` `)
+}
+
+func (c ComposeEngine) Available() bool {
+	if _, err := exec.LookPath(c[0]); err != nil {
+		return false
+	}
+	return exec.Command(c[0], append(c[1:], `version`)...).Run() == nil
+}
+
+func (c ComposeEngine) args(p Project, files []string, args ...string) []string {
+	cmd := append([]string{}, c[1:]...)
+	for _, file := range append(append([]string{}, p.Files...), files...) {
+		cmd = append(cmd, `-f`, p.Path(file))
+	}
+	for _, profile := range p.Profiles {
+		cmd = append(cmd, `--profile`, profile)
+	}
+	return append(cmd, args...)
+}
+
+/* override writes a compose file setting the target, platform and pull
+ * policy of a service, which the compose command line cannot. It returns no
+ * files if none is set, and a function that removes the file.
+ */
+func (c ComposeEngine) override(service string, opts ServiceOptions) ([]string, func(), error) {
+	never := opts.Pull.Policy() == PullNever
+	if opts.Target == `` && opts.Platform == `` && !never {
+		return nil, func() {}, nil
+	}
+
+	svc := make(map[string]interface{})
+	if never {
+		svc[`pull_policy`] = `never`
+	}
+	if opts.Platform != `` {
+		svc[`platform`] = opts.Platform
+	}
+	if opts.Target != `` {
+		svc[`build`] = map[string]string{`target`: opts.Target}
+	}
+	b, err := yaml.Marshal(map[string]interface{}{
+		`services`: map[string]interface{}{service: svc},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := ioutil.TempFile(``, `tsb-compose-*.yml`)
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return []string{f.Name()}, remove, nil
+}
+
+func (c ComposeEngine) BuildImage(ctx context.Context, p Project, service string) error {
+	opts, err := p.ServiceOptions(service)
+	if err != nil {
+		return err
+	}
+	files, remove, err := c.override(service, opts)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	/* compose build pulls missing base images, so check for them first. */
+	if opts.Pull.Policy() == PullNever {
+		err := c.checkBaseImages(ctx, p, service)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{`build`, `--force-rm`}
+	if opts.Pull.Policy() == PullAlways {
+		args = append(args, `--pull`)
+	}
+	if opts.NoCache(p) {
+		args = append(args, `--no-cache`)
+	}
+	args = append(args, buildArgs(opts.BuildArgs)...)
+	b, err := runIn(ctx, ``, nil, c[0], c.args(p, files, append(args, service)...)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+/* checkBaseImages fails if a base image of a service's Dockerfile is not
+ * present.
+ */
+func (c ComposeEngine) checkBaseImages(ctx context.Context, p Project, service string) error {
+	svc := p.Compose.Service(service)
+	if svc == nil || (svc.Build.Context == `` && svc.Build.Dockerfile == ``) {
+		return nil
+	}
+	dockerfile := svc.Build.Dockerfile
+	if dockerfile == `` {
+		dockerfile = `Dockerfile`
+	}
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(p.Path(svc.Build.Context), dockerfile)
+	}
+	b, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return errors.New(`Unable to read the Dockerfile of service ` + service + `: ` + err.Error())
+	}
+	for _, image := range baseImages(b) {
+		if _, err := runIn(ctx, ``, nil, c.cli(), `image`, `inspect`, image); err != nil {
+			return fmt.Errorf("Base image %s of service %s is not present, and its pull policy is never.", image, service)
+		}
+	}
+	return nil
+}
+
+/* baseImages returns the images named by the FROM instructions of a
+ * Dockerfile, leaving out scratch, earlier build stages, and images that
+ * depend on build arguments.
+ */
+func baseImages(dockerfile []byte) []string {
+	var images []string
+	stages := make(map[string]bool)
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], `FROM`) {
+			continue
+		}
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], `--`) {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		image := fields[0]
+		if image != `scratch` && !strings.Contains(image, `$`) && !stages[strings.ToLower(image)] {
+			images = append(images, image)
+		}
+		if len(fields) >= 3 && strings.EqualFold(fields[1], `AS`) {
+			stages[strings.ToLower(fields[2])] = true
+		}
+	}
+	return images
+}
+
+func (c ComposeEngine) RunService(ctx context.Context, p Project, service string) error {
+	opts, err := p.ServiceOptions(service)
+	if err != nil {
+		return err
+	}
+	files, remove, err := c.override(service, opts)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	b, err := runIn(ctx, ``, nil, c[0], c.args(p, files, `run`, `--rm`, service)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+func (c ComposeEngine) Stop(ctx context.Context, p Project) error {
+	b, err := runIn(ctx, ``, nil, c[0], c.args(p, nil, `down`, `--remove-orphans`, `-t`, `10`)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+/* cli is the container command line of the compose implementation. */
+func (c ComposeEngine) cli() string {
+	return strings.TrimSuffix(c[0], `-compose`)
+}
+
+func (c ComposeEngine) Clean(ctx context.Context, p Project) error {
+	b, err := runIn(ctx, ``, nil, c[0], c.args(p, nil, `down`, `--rmi`, `local`, `--remove-orphans`)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	/* down only removes the images it named itself. */
+	for _, name := range p.Compose.ServiceNames() {
+		svc := p.Compose.Service(name)
+		if svc.Image == `` || (svc.Build.Context == `` && svc.Build.Dockerfile == ``) {
+			continue
+		}
+		if _, err := runIn(ctx, ``, nil, c.cli(), `image`, `inspect`, svc.Image); err != nil {
+			continue
+		}
+		b, err := runIn(ctx, ``, nil, c.cli(), `image`, `rm`, svc.Image)
+		if err != nil {
+			return errors.New(err.Error() + "\n" + string(b))
+		}
+	}
+	return nil
+}
+
+/* buildArgs returns --build-arg arguments for args, in order. */
+func buildArgs(args map[string]string) []string {
+	var keys []string
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var flags []string
+	for _, key := range keys {
+		flags = append(flags, `--build-arg`, key+`=`+args[key])
+	}
+	return flags
+}
+
+/* PodmanEngine runs services with podman directly, for hosts without a
+ * compose implementation. It supports the build, image, volumes,
+ * environment, working_dir, entrypoint and command of a service.
+ */
+type PodmanEngine struct{}
+
+func (PodmanEngine) Name() string {
+	return `podman`
+}
+
+func (PodmanEngine) Available() bool {
+	_, err := exec.LookPath(`podman`)
+	return err == nil
+}
+
+/* image names the image of a service. */
+func (PodmanEngine) image(p Project, service string) string {
+	if svc := p.Compose.Service(service); svc != nil && svc.Image != `` {
+		return svc.Image
+	}
+	return strings.ToLower(filepath.Base(p.Dir) + `_` + service)
+}
+
+/* label marks the containers run for a config repository. */
+func (PodmanEngine) label(p Project) string {
+	return `tsb.dir=` + p.Dir
+}
+
+func (e PodmanEngine) Stop(ctx context.Context, p Project) error {
+	b, err := runIn(ctx, ``, nil, `podman`, `ps`, `-aq`, `--filter`, `label=`+e.label(p))
+	if err != nil {
+		return err
+	}
+	ids := strings.Fields(string(b))
+	if len(ids) == 0 {
+		return nil
+	}
+	b, err = runIn(ctx, ``, nil, `podman`, append([]string{`rm`, `-f`, `-t`, `10`}, ids...)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+func (e PodmanEngine) Clean(ctx context.Context, p Project) error {
+	for _, name := range p.Compose.ServiceNames() {
+		svc := p.Compose.Service(name)
+		if svc.Build.Context == `` && svc.Build.Dockerfile == `` {
+			continue
+		}
+		image := e.image(p, name)
+		if _, err := runIn(ctx, ``, nil, `podman`, `image`, `exists`, image); err != nil {
+			continue
+		}
+		b, err := runIn(ctx, ``, nil, `podman`, `rmi`, image)
+		if err != nil {
+			return errors.New(err.Error() + "\n" + string(b))
+		}
+	}
+	return nil
+}
+
+func (e PodmanEngine) BuildImage(ctx context.Context, p Project, service string) error {
+	svc := p.Compose.Service(service)
+	if svc == nil {
+		return errors.New(`No service ` + service + `.`)
+	}
+	opts, err := ServiceOptionsOf(svc)
+	if err != nil {
+		return err
+	}
+	platform := opts.Platform
+	if platform == `` {
+		platform = svc.Platform
+	}
+
+	if svc.Build.Context == `` && svc.Build.Dockerfile == `` {
+		if opts.Pull.Policy() == PullNever {
+			return nil
+		}
+		args := []string{`pull`}
+		if platform != `` {
+			args = append(args, `--platform`, platform)
+		}
+		if opts.Pull.Policy() == PullMissing {
+			if _, err := runIn(ctx, ``, nil, `podman`, `image`, `exists`, svc.Image); err == nil {
+				return nil
+			}
+		}
+		b, err := runIn(ctx, ``, nil, `podman`, append(args, svc.Image)...)
+		if err != nil {
+			return errors.New(err.Error() + "\n" + string(b))
+		}
+		return nil
+	}
+
+	context := p.Path(svc.Build.Context)
+	args := []string{`build`, `--pull=` + string(opts.Pull.Policy()), `--force-rm`, `-t`, e.image(p, service)}
+	if opts.NoCache(p) {
+		args = append(args, `--no-cache`)
+	}
+	if svc.Build.Dockerfile != `` {
+		args = append(args, `-f`, filepath.Join(context, svc.Build.Dockerfile))
+	}
+	target := opts.Target
+	if target == `` {
+		target = svc.Build.Target
+	}
+	if target != `` {
+		args = append(args, `--target`, target)
+	}
+	if platform != `` {
+		args = append(args, `--platform`, platform)
+	}
+	merged := make(map[string]string)
+	for key, value := range svc.Build.Args {
+		if value != nil {
+			merged[key] = *value
+		}
+	}
+	for key, value := range opts.BuildArgs {
+		merged[key] = value
+	}
+	args = append(args, buildArgs(merged)...)
+	b, err := runIn(ctx, ``, nil, `podman`, append(args, context)...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+func (e PodmanEngine) RunService(ctx context.Context, p Project, service string) error {
+	svc := p.Compose.Service(service)
+	if svc == nil {
+		return errors.New(`No service ` + service + `.`)
+	}
+	opts, err := ServiceOptionsOf(svc)
+	if err != nil {
+		return err
+	}
+
+	args := []string{`run`, `--rm`, `--pull=never`, `--label`, e.label(p)}
+	if opts.Platform != `` {
+		args = append(args, `--platform`, opts.Platform)
+	} else if svc.Platform != `` {
+		args = append(args, `--platform`, svc.Platform)
+	}
+	for _, vol := range svc.Volumes {
+		source := vol.Source
+		if strings.HasPrefix(source, `.`) || strings.HasPrefix(source, `/`) {
+			source = p.Path(source)
+		}
+		mount := source + `:` + vol.Target
+		if vol.ReadOnly {
+			mount += `:ro`
+		}
+		args = append(args, `-v`, mount)
+	}
+	var keys []string
+	for key := range svc.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value := svc.Environment[key]; value != nil {
+			args = append(args, `-e`, key+`=`+*value)
+		} else {
+			args = append(args, `-e`, key)
+		}
+	}
+	if svc.WorkingDir != `` {
+		args = append(args, `-w`, svc.WorkingDir)
+	}
+	if svc.User != `` {
+		args = append(args, `-u`, svc.User)
+	}
+	if len(svc.Entrypoint) > 0 {
+		args = append(args, `--entrypoint`, svc.Entrypoint[0])
+	}
+	args = append(args, e.image(p, service))
+	if len(svc.Entrypoint) > 1 {
+		args = append(args, svc.Entrypoint[1:]...)
+	}
+	args = append(args, svc.Command...)
+
+	b, err := runIn(ctx, ``, nil, `podman`, args...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
+
+/* HostEngine runs a command for each service directly on the host, for
+ * build agents that cannot run containers. The command is the x-tsb command
+ * of the service, or else its entrypoint and command. It runs in the config
+ * repository, with SRC and DIST set to the src and dist directories.
+ */
+type HostEngine struct{}
+
+func (HostEngine) Name() string {
+	return `host`
+}
+
+func (HostEngine) Available() bool {
+	return true
+}
+
+func (HostEngine) BuildImage(ctx context.Context, p Project, service string) error {
+	return nil
+}
+
+/* Command returns what the host engine runs for a service. */
+func (HostEngine) Command(p Project, service string) ([]string, error) {
+	svc := p.Compose.Service(service)
+	if svc == nil {
+		return nil, errors.New(`No service ` + service + `.`)
+	}
+	opts, err := ServiceOptionsOf(svc)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Command) > 0 {
+		return opts.Command, nil
+	}
+	cmd := append(append([]string{}, svc.Entrypoint...), svc.Command...)
+	if len(cmd) == 0 {
+		return nil, errors.New(`Service ` + service + ` has no command to run on the host; set command in its ` + OptionsKey + ` extension.`)
+	}
+	return cmd, nil
+}
+
+/* Env returns the variables the host engine adds to the environment. */
+func (HostEngine) Env(p Project, service string) []string {
+	env := []string{
+		`SRC=` + p.Src,
+		`DIST=` + p.Dist,
+	}
+	if svc := p.Compose.Service(service); svc != nil {
+		var keys []string
+		for key := range svc.Environment {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if value := svc.Environment[key]; value != nil {
+				env = append(env, key+`=`+*value)
+			}
+		}
+	}
+	return env
+}
+
+/* Stop has nothing to do, since host commands are killed when cancelled. */
+func (HostEngine) Stop(ctx context.Context, p Project) error {
+	return nil
+}
+
+/* Clean has nothing to do, since the host engine builds no images. */
+func (HostEngine) Clean(ctx context.Context, p Project) error {
+	return nil
+}
+
+func (h HostEngine) RunService(ctx context.Context, p Project, service string) error {
+	cmd, err := h.Command(p, service)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		err = os.MkdirAll(p.Dist, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := runIn(ctx, p.Dir, h.Env(p, service), cmd[0], cmd[1:]...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + string(b))
+	}
+	return nil
+}
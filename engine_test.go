@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/comcast/tsb/loadfiles"
+)
+
+/* FakeEngine records what it is asked to do instead of doing it, so that
+ * build orchestration can be exercised without a container engine. Calls
+ * named in Fail return that error, and those named in Block wait until they
+ * are cancelled.
+ */
+type FakeEngine struct {
+	Calls []string
+	Fail  map[string]error
+	Block map[string]bool
+}
+
+func (*FakeEngine) Name() string {
+	return `fake`
+}
+
+func (*FakeEngine) Available() bool {
+	return true
+}
+
+func (f *FakeEngine) call(ctx context.Context, name string) error {
+	f.Calls = append(f.Calls, name)
+	if f.Block[name] {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return f.Fail[name]
+}
+
+func (f *FakeEngine) BuildImage(ctx context.Context, p Project, service string) error {
+	return f.call(ctx, `build `+service)
+}
+
+func (f *FakeEngine) RunService(ctx context.Context, p Project, service string) error {
+	return f.call(ctx, `run `+service)
+}
+
+func (f *FakeEngine) Stop(ctx context.Context, p Project) error {
+	return f.call(ctx, `stop`)
+}
+
+func (f *FakeEngine) Clean(ctx context.Context, p Project) error {
+	return f.call(ctx, `clean`)
+}
+
+/* testBuild builds a config repository holding only the compose file with
+ * engine, without the build cache.
+ */
+func testBuild(t *testing.T, compose string, engine BuildEngine, opts BuildOptions) error {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, ComposeFile), []byte(compose), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg Config
+	cfg.Compose, cfg.ComposeFiles, cfg.ComposeProfiles, err = LoadCompose(loadfiles.OsFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Executor{configRepo: dir, engine: engine}
+	opts.NoCache = true
+	return e.Build(&cfg, opts, Worktree(filepath.Join(dir, `src`, WorktreesDir, `build-test`)))
+}
+
+func TestBuildProfiles(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  base:
+    image: base
+    volumes:
+      - ./dist:/dist
+  docs:
+    image: docs
+    profiles: [docs]
+    volumes:
+      - ./dist:/dist
+  debug:
+    image: debug
+    profiles: [debug]
+    volumes_from: [base]
+    volumes:
+      - ./dist:/dist
+`
+	tests := []struct {
+		profiles []string
+		want     []string
+	}{
+		{nil, []string{`build base`, `run base`}},
+		{[]string{`docs`}, []string{`build base`, `run base`, `build docs`, `run docs`}},
+	}
+	for _, test := range tests {
+		engine := &FakeEngine{}
+		err := testBuild(t, compose, engine, BuildOptions{Profiles: test.profiles})
+		if err != nil {
+			t.Errorf("profiles %v: %v", test.profiles, err)
+		}
+		if !reflect.DeepEqual(engine.Calls, test.want) {
+			t.Errorf("profiles %v: calls %v; want %v", test.profiles, engine.Calls, test.want)
+		}
+	}
+}
+
+func TestBuildFatalIssues(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  debug:
+    image: debug
+    profiles: [debug]
+    volumes_from: [base]
+    volumes:
+      - ./dist:/dist
+`
+	engine := &FakeEngine{}
+	err := testBuild(t, compose, engine, BuildOptions{Profiles: []string{`debug`}})
+	if err == nil || !strings.Contains(err.Error(), `volumes_from`) {
+		t.Errorf("Build = %v; want an unsupported compose file", err)
+	}
+	if len(engine.Calls) > 0 {
+		t.Errorf("calls %v; want none", engine.Calls)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  a:
+    image: a
+    volumes:
+      - ./dist:/dist
+  b:
+    image: b
+    volumes:
+      - ./dist:/dist
+  c:
+    image: c
+    volumes:
+      - ./dist:/dist
+`
+	engine := &FakeEngine{Fail: map[string]error{`run b`: errors.New(`boom`)}}
+	err := testBuild(t, compose, engine, BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), `Failed to build b: boom`) {
+		t.Errorf("Build = %v; want the failure of b", err)
+	}
+	want := []string{`build a`, `run a`, `build b`, `run b`}
+	if !reflect.DeepEqual(engine.Calls, want) {
+		t.Errorf("calls %v; want %v", engine.Calls, want)
+	}
+}
+
+func TestBuildServiceTimeout(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  slow:
+    image: slow
+    volumes:
+      - ./dist:/dist
+    x-tsb:
+      timeout: 10ms
+`
+	engine := &FakeEngine{Block: map[string]bool{`run slow`: true}}
+	err := testBuild(t, compose, engine, BuildOptions{})
+	if _, ok := err.(TimedOut); !ok {
+		t.Errorf("Build = %v; want a timeout", err)
+	}
+	want := []string{`build slow`, `run slow`, `stop`}
+	if !reflect.DeepEqual(engine.Calls, want) {
+		t.Errorf("calls %v; want %v", engine.Calls, want)
+	}
+}
+
+func TestBuildRestoresEnv(t *testing.T) {
+	compose := `
+version: "3"
+services:
+  a:
+    image: a
+    volumes:
+      - ${TSB_SRC:-./src}:/src
+      - ${TSB_DIST:-./dist}:/dist
+`
+	os.Unsetenv(SrcEnv)
+	os.Setenv(DistEnv, `./dist`)
+	defer os.Unsetenv(DistEnv)
+
+	err := testBuild(t, compose, &FakeEngine{}, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, set := os.LookupEnv(SrcEnv); set {
+		t.Errorf("%s = %q after the build; want it unset", SrcEnv, value)
+	}
+	if value := os.Getenv(DistEnv); value != `./dist` {
+		t.Errorf("%s = %q after the build; want ./dist", DistEnv, value)
+	}
+}
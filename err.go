@@ -18,8 +18,11 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type FailedCommand struct {
@@ -50,3 +53,58 @@ func (err FailedCommand) Error() string {
 	}
 	return s
 }
+
+type PatchError struct {
+	Repo  string
+	Patch string
+	Err   error
+}
+
+func NewPatchError(err error, repo, patch string) error {
+	if err == nil {
+		return nil
+	}
+	return &PatchError{
+		Repo:  repo,
+		Patch: patch,
+		Err:   err,
+	}
+}
+
+func (err PatchError) Error() string {
+	return fmt.Sprintf("Unable to apply %s to %s: %s", err.Patch, err.Repo, err.Err.Error())
+}
+
+/* Interrupted is returned when a command is stopped by a signal. */
+type Interrupted struct {
+	Signal os.Signal
+}
+
+func (err Interrupted) Error() string {
+	if err.Signal == nil {
+		return `Interrupted.`
+	}
+	return fmt.Sprintf("Interrupted by %s.", err.Signal)
+}
+
+/* ExitCode follows the shell convention of 128 plus the signal number. */
+func (err Interrupted) ExitCode() int {
+	if sig, ok := err.Signal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 130
+}
+
+/* TimedOut is returned when a build takes longer than its timeout. */
+type TimedOut struct {
+	After time.Duration
+}
+
+func (err TimedOut) Error() string {
+	return fmt.Sprintf("Timed out after %s.", err.After)
+}
+
+/* ExitCode is that of timeout(1). */
+func (err TimedOut) ExitCode() int {
+	return 124
+}
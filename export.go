@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var mboxSeparator = regexp.MustCompile(`(?m)^From [0-9a-f]{40} `)
+
+/* splitMbox splits a mailbox into its messages. */
+func splitMbox(mbox []byte) [][]byte {
+	var msgs [][]byte
+	locs := mboxSeparator.FindAllIndex(mbox, -1)
+	if len(locs) == 0 {
+		return [][]byte{mbox}
+	}
+	for i, loc := range locs {
+		end := len(mbox)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		msgs = append(msgs, mbox[loc[0]:end])
+	}
+	return msgs
+}
+
+/* addPatchHeader adds a header line to the end of a message's headers. */
+func addPatchHeader(msg []byte, name, value string) []byte {
+	i := bytes.Index(msg, []byte("\n\n"))
+	if i < 0 {
+		return msg
+	}
+	header := []byte("\n" + name + `: ` + value)
+	return append(append(append([]byte{}, msg[:i]...), header...), msg[i:]...)
+}
+
+var slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+/* patchFilename names a patch the way git format-patch would. */
+func patchFilename(n int, subject string) string {
+	slug := strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(subject), `-`), `-`)
+	if len(slug) > 52 {
+		slug = strings.TrimRight(slug[:52], `-`)
+	}
+	return fmt.Sprintf(`%04d-%s.patch`, n, slug)
+}
+
+/* formatChangeset returns a changeset as an email message. */
+func formatChangeset(g gitRepo, chg Changeset) ([]byte, error) {
+	merge, err := g.isMerge(chg.Node)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if merge {
+		/* format-patch skips merges; export them against their first parent. */
+		b, err = g.git(`log`, `-1`, `-p`, `--stat`, `--pretty=email`, `--diff-merges=first-parent`, chg.Node)
+	} else {
+		b, err = g.git(`format-patch`, `-1`, `--stdout`, chg.Node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if chg.Ref != `` {
+		b = addPatchHeader(b, `X-Tsb-Ref`, chg.Ref)
+	}
+	return b, nil
+}
+
+/* ExportPatches writes the patches for each repository as a numbered patch
+ * series, with a quilt series file, to {out}/{repo}.
+ */
+func (e *Executor) ExportPatches() error {
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+
+	var repos []string
+	var out string
+	for e.HasArg() {
+		arg := e.PeekArg()
+		if arg == `--out` {
+			e.PopArg()
+			out = e.PopArg()
+		} else if _, ok := cfg.Repos[arg]; ok {
+			e.PopArg()
+			repos = append(repos, arg)
+		} else {
+			break
+		}
+	}
+	if out == `` {
+		return errors.New(`No output directory provided to export-patches; use --out {dir}.`)
+	}
+	if len(repos) == 0 {
+		for repo := range cfg.Patches {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+	}
+
+	for _, repo := range repos {
+		err := e.exportRepoPatches(cfg, repo, filepath.Join(out, repo))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Executor) exportRepoPatches(cfg *Config, repo, dir string) error {
+	g := gitRepo(path.Join(e.Dir(), `src`, repo))
+
+	var msgs [][]byte
+	for _, patch_item := range cfg.Patches[repo] {
+		if patch_item.Change.Node != "" {
+			b, err := formatChangeset(g, patch_item.Change)
+			if err != nil {
+				return fmt.Errorf(`Unable to export %s from %s: %s`, patch_item.Change.Node, repo, err.Error())
+			}
+			msgs = append(msgs, b)
+		} else if patch_item.Sub != nil {
+			for _, changeset := range patch_item.Sub.Changesets {
+				b, err := formatChangeset(g, changeset)
+				if err != nil {
+					return fmt.Errorf(`Unable to export %s from %s: %s`, changeset.Node, repo, err.Error())
+				}
+				msgs = append(msgs, b)
+			}
+		} else if patch_item.File != nil {
+			b, err := patch_item.File.Read(e.ConfigRoot(e.at))
+			if err != nil {
+				return err
+			}
+			for _, msg := range splitMbox(b) {
+				msgs = append(msgs, addPatchHeader(msg, `X-Tsb-Patch-File`, patch_item.File.Path))
+			}
+		} else {
+			return errors.New("Unrecognized format in patches yaml")
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Would write %d patches for %s to %s.\n", len(msgs), repo, dir)
+		return nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var series []string
+	for i, msg := range msgs {
+		subject := ``
+		if subjects := PatchSubjects(msg); len(subjects) > 0 {
+			subject = subjects[0]
+		}
+		name := patchFilename(i+1, subject)
+		err := ioutil.WriteFile(filepath.Join(dir, name), msg, 0644)
+		if err != nil {
+			return err
+		}
+		series = append(series, name)
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Exported %d patches for %s to %s.\n", len(series), repo, dir)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, `series`), []byte(strings.Join(series, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/* SubscriptionFilter selects commits of a subscription. Paths are globs
+ * matched against each changed file and its leading directories, authors are
+ * email addresses, and messages are regular expressions matched against the
+ * full commit message.
+ */
+type SubscriptionFilter struct {
+	Paths    []string `yaml:"paths,omitempty"`
+	Authors  []string `yaml:"authors,omitempty"`
+	Messages []string `yaml:"messages,omitempty"`
+}
+
+/* commitInfo is what the filters need to know about a commit. Each part is
+ * only looked up when a filter asks for it.
+ */
+type commitInfo struct {
+	repo    gitRepo
+	chg     Changeset
+	files   []string
+	message string
+}
+
+func (c *commitInfo) Author() string {
+	/* The ref is <date!email>. */
+	ref := strings.TrimSuffix(strings.TrimPrefix(c.chg.Ref, `<`), `>`)
+	if i := strings.LastIndex(ref, `!`); i >= 0 {
+		return ref[i+1:]
+	}
+	return ref
+}
+
+func (c *commitInfo) Files() ([]string, error) {
+	if c.files != nil {
+		return c.files, nil
+	}
+	merge, err := c.repo.isMerge(c.chg.Node)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if merge {
+		/* Merges are taken relative to their first parent. */
+		b, err = c.repo.git(`diff-tree`, `-r`, `--name-only`, `--no-commit-id`, c.chg.Node+`^1`, c.chg.Node)
+	} else {
+		b, err = c.repo.git(`diff-tree`, `-r`, `--name-only`, `--no-commit-id`, `--root`, c.chg.Node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.files = strings.Fields(string(b))
+	if c.files == nil {
+		c.files = []string{}
+	}
+	return c.files, nil
+}
+
+func (c *commitInfo) Message() (string, error) {
+	if c.message != `` {
+		return c.message, nil
+	}
+	b, err := c.repo.git(`log`, `-n1`, `--format=%B`, c.chg.Node)
+	if err != nil {
+		return ``, err
+	}
+	c.message = string(b)
+	return c.message, nil
+}
+
+/* matchPath reports whether pattern matches file or one of its directories. */
+func matchPath(pattern, file string) bool {
+	for p := file; p != `.` && p != `/` && p != ``; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAuthor(authors []string, email string) bool {
+	for _, author := range authors {
+		if strings.EqualFold(author, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMessage(exprs []*regexp.Regexp, message string) bool {
+	for _, expr := range exprs {
+		if expr.MatchString(message) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileMessages(f *SubscriptionFilter) ([]*regexp.Regexp, error) {
+	if f == nil {
+		return nil, nil
+	}
+	var exprs []*regexp.Regexp
+	for _, msg := range f.Messages {
+		expr, err := regexp.Compile(msg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid message filter %q: %s", msg, err.Error())
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+/* Filter applies the subscription's include and exclude rules to changesets.
+ *
+ * A commit is kept if it touches at least one of the included paths, is by
+ * one of the included authors, and has a message matching one of the included
+ * expressions; rules that are not given always match. A kept commit is then
+ * dropped if every path it touches is excluded, if it is by an excluded
+ * author, or if its message matches an excluded expression.
+ */
+func (s *Subscription) Filter(repo gitRepo, name string, changesets []Changeset) ([]Changeset, error) {
+	includeMsgs, err := compileMessages(s.Include)
+	if err != nil {
+		return nil, err
+	}
+	excludeMsgs, err := compileMessages(s.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []Changeset
+	for _, chg := range changesets {
+		c := &commitInfo{repo: repo, chg: chg}
+		reason, err := s.excludeReason(c, includeMsgs, excludeMsgs)
+		if err != nil {
+			return nil, err
+		}
+		if reason == `` {
+			kept = append(kept, chg)
+		} else if verbose {
+			fmt.Fprintf(os.Stderr, "Excluded from subscription to %s in %s (%s): %s %s %s\n", s.Branch, name, reason, chg.Node, chg.Ref, chg.Comment)
+		}
+	}
+	return kept, nil
+}
+
+/* excludeReason returns why c is filtered out, or "" if it is kept. */
+func (s *Subscription) excludeReason(c *commitInfo, includeMsgs, excludeMsgs []*regexp.Regexp) (string, error) {
+	if inc := s.Include; inc != nil {
+		if len(inc.Paths) > 0 {
+			files, err := c.Files()
+			if err != nil {
+				return ``, err
+			}
+			found := false
+			for _, file := range files {
+				for _, pattern := range inc.Paths {
+					found = found || matchPath(pattern, file)
+				}
+			}
+			if !found {
+				return `no included paths`, nil
+			}
+		}
+		if len(inc.Authors) > 0 && !matchAuthor(inc.Authors, c.Author()) {
+			return `author not included`, nil
+		}
+		if len(includeMsgs) > 0 {
+			msg, err := c.Message()
+			if err != nil {
+				return ``, err
+			}
+			if !matchMessage(includeMsgs, msg) {
+				return `message not included`, nil
+			}
+		}
+	}
+
+	if exc := s.Exclude; exc != nil {
+		if len(exc.Paths) > 0 {
+			files, err := c.Files()
+			if err != nil {
+				return ``, err
+			}
+			all := len(files) > 0
+			for _, file := range files {
+				matched := false
+				for _, pattern := range exc.Paths {
+					matched = matched || matchPath(pattern, file)
+				}
+				all = all && matched
+			}
+			if all {
+				return `excluded paths`, nil
+			}
+		}
+		if matchAuthor(exc.Authors, c.Author()) {
+			return `excluded author`, nil
+		}
+		if len(excludeMsgs) > 0 {
+			msg, err := c.Message()
+			if err != nil {
+				return ``, err
+			}
+			if matchMessage(excludeMsgs, msg) {
+				return `excluded message`, nil
+			}
+		}
+	}
+	return ``, nil
+}
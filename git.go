@@ -18,7 +18,10 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -49,10 +52,64 @@ func init() {
 }
 
 func run(cmd string, args ...string) ([]byte, error) {
+	return runIn(runContext, ``, nil, cmd, args...)
+}
+
+/* runIn runs a command in dir (the current directory if empty), with env
+ * added to the environment, killing it if ctx is done first. In a dry run,
+ * commands that would change anything are printed instead.
+ */
+func runIn(ctx context.Context, dir string, env []string, cmd string, args ...string) ([]byte, error) {
+	if dryRun && !readOnly(cmd, args) {
+		recordCommand(dir, cmd, args)
+		return nil, nil
+	}
 	if verbose {
 		fmt.Fprintf(os.Stderr, "%s %s\n", cmd, strings.Join(args, ` `))
 	}
-	b, err := exec.Command(cmd, args...).Output()
+	c := exec.Command(cmd, args...)
+	c.Dir = dir
+	if env != nil {
+		c.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	group := ctx.Value(processGroupKey{}) != nil
+	if group {
+		setProcessGroup(c)
+	}
+
+	err := c.Start()
+	if err == nil && ctx.Done() != nil {
+		/* Kill the command once ctx is done; the whole group if it has
+		 * one, so that children holding the output open do not keep us
+		 * waiting.
+		 */
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				if group {
+					killProcessGroup(c)
+				} else {
+					c.Process.Kill()
+				}
+			case <-done:
+			}
+		}()
+		err = c.Wait()
+		close(done)
+	} else if err == nil {
+		err = c.Wait()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(`timed out`)
+	}
+	b := stdout.Bytes()
 	if verbose {
 		fmt.Fprintf(os.Stderr, "|>\t%s\n", bytes.Replace(bytes.TrimSpace(b), []byte{'\n'}, []byte{'\n', '|', '>', '\t'}, -1))
 	}
@@ -65,11 +122,44 @@ func git(args ...string) ([]byte, error) {
 
 type gitRepo string
 
+/* gitDir is the git directory of the repository. In a worktree, .git is a
+ * file naming the worktree's own directory in the main repository.
+ */
 func (r gitRepo) gitDir() string {
-	return filepath.Join(string(r), `.git`)
+	dotGit := filepath.Join(string(r), `.git`)
+	if fi, err := os.Stat(dotGit); err != nil || fi.IsDir() {
+		return dotGit
+	}
+	b, err := ioutil.ReadFile(dotGit)
+	if err != nil {
+		return dotGit
+	}
+	dir := strings.TrimSpace(strings.TrimPrefix(string(b), `gitdir:`))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(string(r), dir)
+	}
+	return dir
 }
 
 func (r gitRepo) git(args ...string) ([]byte, error) {
+	if dryRun && readOnly(`git`, args) {
+		/* A dry run makes no worktrees, but they share the history of the
+		 * repository they would be made from.
+		 */
+		if _, err := os.Stat(string(r)); err != nil {
+			if repo := worktreeRepo(string(r)); repo != `` {
+				r = gitRepo(repo)
+			}
+		}
+	}
 	args = append([]string{`--git-dir=` + r.gitDir(), `--work-tree=` + string(r)}, args...)
 	return git(args...)
 }
+
+func (r gitRepo) isMerge(rev string) (bool, error) {
+	parents, err := r.git(`rev-list`, `--parents`, `-n1`, rev)
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.Fields(parents)) > 2, nil
+}
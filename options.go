@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/comcast/tsb/docker-types"
+	"gopkg.in/yaml.v3"
+)
+
+/* OptionsKey is the compose extension that holds tsb's own settings. */
+const OptionsKey = `x-tsb`
+
+/* Options are the tsb settings kept in the x-tsb extension of the compose file. */
+type Options struct {
+	/* StalePatchDays is how long a patch may be carried before validate warns about it. */
+	StalePatchDays int `yaml:"stale-patch-days,omitempty"`
+	/* StalePatchUpdates is how many updates a patch may survive before validate warns about it. */
+	StalePatchUpdates int `yaml:"stale-patch-updates,omitempty"`
+	/* Engine is the build engine to use; see FindEngine. */
+	Engine string `yaml:"engine,omitempty"`
+	/* CacheDir is where successful builds are cached; the user's cache
+	 * directory if empty.
+	 */
+	CacheDir string `yaml:"cache-dir,omitempty"`
+	/* Timeout limits how long a whole build may take. */
+	Timeout types.Duration `yaml:"timeout,omitempty"`
+	/* Dist is how the dist directory is prepared for a build. */
+	Dist DistMode `yaml:"dist,omitempty"`
+}
+
+/* decodeExtension decodes a compose extension value into obj. */
+func decodeExtension(ext interface{}, obj interface{}) error {
+	if ext == nil {
+		return nil
+	}
+	b, err := yaml.Marshal(ext)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, obj)
+}
+
+/* Options returns the tsb settings of the compose file. */
+func (c Compose) Options() (Options, error) {
+	var opts Options
+	err := decodeExtension(c.Extras[OptionsKey], &opts)
+	if err != nil {
+		return opts, errors.New(`Invalid ` + OptionsKey + ` in compose file: ` + err.Error())
+	}
+	return opts, nil
+}
+
+/* HostCommand is a command for the host engine: a string run by the shell,
+ * or a list of arguments.
+ */
+type HostCommand []string
+
+func (c *HostCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err == nil {
+		*c = HostCommand{`/bin/sh`, `-c`, line}
+		return nil
+	}
+	return unmarshal((*[]string)(c))
+}
+
+/* ServiceOptions are the tsb settings kept in the x-tsb extension of a
+ * compose service.
+ */
+type ServiceOptions struct {
+	/* Command is what the host engine runs for the service, instead of its
+	 * entrypoint and command.
+	 */
+	Command HostCommand `yaml:"command,omitempty"`
+	/* Pull is when to pull base images: always (the default), missing or never. */
+	Pull PullPolicy `yaml:"pull,omitempty"`
+	/* Cache, if false, builds the image without cached layers. */
+	Cache *bool `yaml:"cache,omitempty"`
+	/* BuildArgs are added to the build arguments of the image. */
+	BuildArgs map[string]string `yaml:"build-args,omitempty"`
+	/* Target is the stage of a multi-stage Dockerfile to build. */
+	Target string `yaml:"target,omitempty"`
+	/* Platform is the platform to build and run the image for. */
+	Platform string `yaml:"platform,omitempty"`
+	/* Timeout limits how long building and running the service may take. */
+	Timeout types.Duration `yaml:"timeout,omitempty"`
+	/* Artefacts are glob patterns, relative to dist, of the files the
+	 * service must produce.
+	 */
+	Artefacts []string `yaml:"artefacts,omitempty"`
+}
+
+type PullPolicy string
+
+const (
+	// PullAlways pulls newer versions of base images on every build.
+	PullAlways = PullPolicy("always")
+	// PullMissing pulls base images only if they are not present.
+	PullMissing = PullPolicy("missing")
+	// PullNever uses only base images that are present.
+	PullNever = PullPolicy("never")
+	// PullDefault represents an unset pull policy, which is PullAlways.
+	PullDefault = PullPolicy("")
+)
+
+func (p *PullPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch PullPolicy(s) {
+	case PullAlways, PullMissing, PullNever, PullDefault:
+		*p = PullPolicy(s)
+		return nil
+	}
+	return errors.New(`unknown pull policy ` + s + `; expected always, missing or never`)
+}
+
+/* Policy returns the pull policy, with the default resolved. */
+func (p PullPolicy) Policy() PullPolicy {
+	if p == PullDefault {
+		return PullAlways
+	}
+	return p
+}
+
+/* NoCache reports whether the service's image is built without cached layers. */
+func (opts ServiceOptions) NoCache(p Project) bool {
+	return p.NoCache || (opts.Cache != nil && !*opts.Cache)
+}
+
+/* ServiceOptionsOf returns the tsb settings of a compose service. */
+func ServiceOptionsOf(svc *types.ServiceConfig) (ServiceOptions, error) {
+	var opts ServiceOptions
+	err := decodeExtension(svc.Extras[OptionsKey], &opts)
+	if err != nil {
+		return opts, errors.New(`Invalid ` + OptionsKey + ` in service ` + svc.Name + `: ` + err.Error())
+	}
+	return opts, nil
+}
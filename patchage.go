@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type PatchAge struct {
+	Patch Patch
+	/* Added is when the patch was first committed to patches.yml, and
+	 * AddedIn the config commit that did so. Both are empty for patches that
+	 * have not been committed.
+	 */
+	Added   time.Time
+	AddedIn string
+	/* Authored is the author date of the patch. */
+	Authored time.Time
+	/* Updates is the number of times the repository head has moved since
+	 * the patch was added.
+	 */
+	Updates int
+}
+
+/* Carried returns how long the patch has been carried, in days. */
+func (a PatchAge) Carried() int {
+	if !a.Added.IsZero() {
+		return ageInDays(a.Added)
+	}
+	if !a.Authored.IsZero() {
+		return ageInDays(a.Authored)
+	}
+	return 0
+}
+
+/* Stale returns why the patch is stale by the thresholds in opts, or "". */
+func (opts Options) Stale(a PatchAge) string {
+	var reasons []string
+	if 0 < opts.StalePatchDays && opts.StalePatchDays < a.Carried() {
+		reasons = append(reasons, fmt.Sprintf(`carried for %d days`, a.Carried()))
+	}
+	if 0 < opts.StalePatchUpdates && opts.StalePatchUpdates < a.Updates {
+		reasons = append(reasons, fmt.Sprintf(`survived %d updates`, a.Updates))
+	}
+	return strings.Join(reasons, `, `)
+}
+
+/* patchSearchKey is the text that identifies a patch in patches.yml. */
+func patchSearchKey(p Patch) string {
+	switch {
+	case p.Sub != nil:
+		return p.Sub.Branch
+	case p.File != nil:
+		return p.File.Path
+	}
+	return p.Change.Node
+}
+
+/* configHistory is the history of the config repository, oldest first. */
+type configHistory struct {
+	git   gitRepo
+	rev   string
+	index map[string]int
+	/* heads lists, per repository, the commits that moved its head. */
+	heads map[string][]string
+}
+
+func (e *Executor) configHistory() (*configHistory, error) {
+	h := &configHistory{
+		git:   gitRepo(e.Dir()),
+		rev:   `HEAD`,
+		index: make(map[string]int),
+		heads: make(map[string][]string),
+	}
+	if e.at != `` {
+		h.rev = e.at
+	}
+
+	b, err := h.git.git(`rev-list`, `--reverse`, `--topo-order`, h.rev)
+	if err != nil {
+		return nil, err
+	}
+	for i, commit := range strings.Fields(string(b)) {
+		h.index[commit] = i
+	}
+
+	b, err = h.git.git(`rev-list`, `--reverse`, `--topo-order`, h.rev, `--`, `repos.yml`)
+	if err != nil {
+		return nil, err
+	}
+	prev := make(map[string]string)
+	for _, commit := range strings.Fields(string(b)) {
+		rb, err := h.git.git(`show`, commit+`:repos.yml`)
+		if err != nil {
+			continue
+		}
+		var repos Repos
+		if yaml.Unmarshal(rb, &repos) != nil {
+			continue
+		}
+		for name, repo := range repos {
+			if repo == nil || repo.Head == `` {
+				continue
+			}
+			if old, ok := prev[name]; ok && old != repo.Head {
+				h.heads[name] = append(h.heads[name], commit)
+			}
+			prev[name] = repo.Head
+		}
+	}
+	return h, nil
+}
+
+/* added finds the first config commit that mentions the patch in patches.yml. */
+func (h *configHistory) added(p Patch) (string, time.Time) {
+	b, err := h.git.git(`log`, `--reverse`, `--format=%H %aI`, `-S`+patchSearchKey(p), h.rev, `--`, `patches.yml`)
+	if err != nil {
+		return ``, time.Time{}
+	}
+	fields := strings.Fields(string(bytes.SplitN(b, []byte{'\n'}, 2)[0]))
+	if len(fields) < 2 {
+		return ``, time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, fields[1])
+	return fields[0], t
+}
+
+/* updatesSince counts head moves of repo after commit. */
+func (h *configHistory) updatesSince(repo, commit string) int {
+	start, ok := h.index[commit]
+	if !ok {
+		return 0
+	}
+	count := 0
+	for _, c := range h.heads[repo] {
+		if h.index[c] > start {
+			count++
+		}
+	}
+	return count
+}
+
+/* PatchAges returns the age of every patch, by repository. */
+func (e *Executor) PatchAges(cfg *Config) (map[string][]PatchAge, error) {
+	h, err := e.configHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	ages := make(map[string][]PatchAge)
+	for repo, patches := range cfg.Patches {
+		for _, p := range patches {
+			age := PatchAge{Patch: p}
+			age.AddedIn, age.Added = h.added(p)
+			age.Authored, _ = e.PatchDate(repo, p)
+			if age.AddedIn != `` {
+				age.Updates = h.updatesSince(repo, age.AddedIn)
+			}
+			ages[repo] = append(ages[repo], age)
+		}
+	}
+	return ages, nil
+}
+
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return `unknown`
+	}
+	return fmt.Sprintf(`%s (%d days ago)`, t.Format(`2006-01-02`), ageInDays(t))
+}
+
+func (e *Executor) PrintPatchAge() error {
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+	opts, err := cfg.Compose.Options()
+	if err != nil {
+		return err
+	}
+	ages, err := e.PatchAges(cfg)
+	if err != nil {
+		return err
+	}
+
+	var repos []string
+	for repo := range ages {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		fmt.Printf("Patch age for %s:\n", repo)
+		for _, age := range ages[repo] {
+			fmt.Printf("\t%s\n", age.Patch.Describe())
+			if age.AddedIn == `` {
+				fmt.Printf("\t\tAdded:    not committed\n")
+			} else {
+				fmt.Printf("\t\tAdded:    %s in %.12s\n", formatAge(age.Added), age.AddedIn)
+			}
+			fmt.Printf("\t\tAuthored: %s\n", formatAge(age.Authored))
+			fmt.Printf("\t\tUpdates:  %d\n", age.Updates)
+			if reason := opts.Stale(age); reason != `` {
+				fmt.Printf("\t\tStale:    %s\n", reason)
+			}
+		}
+	}
+	return nil
+}
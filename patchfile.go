@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/comcast/tsb/loadfiles"
+)
+
+/* PatchFile is a patch series in mailbox format (as written by git
+ * format-patch), stored in the config repository.
+ */
+type PatchFile struct {
+	Path     string    `yaml:"file"`
+	Upstream *Upstream `yaml:"upstream,omitempty"`
+}
+
+/* Read returns the contents of the patch file relative to the config root. */
+func (pf PatchFile) Read(root loadfiles.File) ([]byte, error) {
+	file := root.In(pf.Path)
+	f, err := file.Open()
+	if err != nil {
+		return nil, errors.New(`Unable to open patch file ` + file.String() + `: ` + err.Error())
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+var patchSubjectPrefix = regexp.MustCompile(`^\[PATCH[^\]]*\]\s*`)
+
+/* PatchSubjects returns the subject line of every message in a mailbox. */
+func PatchSubjects(mbox []byte) []string {
+	var subjects []string
+	var subject *string
+	inHeader := true
+	scanner := bufio.NewScanner(bytes.NewReader(mbox))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, `From `) && !inHeader:
+			/* Start of the next message in the mailbox. */
+			inHeader = true
+		case !inHeader:
+		case line == ``:
+			inHeader = false
+			subject = nil
+		case subject != nil && (strings.HasPrefix(line, ` `) || strings.HasPrefix(line, "\t")):
+			/* Folded header continuation. */
+			*subject += ` ` + strings.TrimSpace(line)
+		case strings.HasPrefix(line, `Subject:`):
+			subjects = append(subjects, strings.TrimSpace(strings.TrimPrefix(line, `Subject:`)))
+			subject = &subjects[len(subjects)-1]
+		default:
+			subject = nil
+		}
+	}
+	for i := range subjects {
+		subjects[i] = patchSubjectPrefix.ReplaceAllString(subjects[i], ``)
+	}
+	return subjects
+}
+
+/* Am applies a mailbox with git am, falling back on a three-way merge. */
+func (r *Repo) Am(dir, name, mbox string) error {
+	repo := gitRepo(filepath.Join(dir, `src`, name))
+	_, err := repo.git(`am`, `-3`, mbox)
+	if err != nil {
+		_, _ = repo.git(`am`, `--abort`)
+	}
+	return err
+}
+
+/* ApplyPatchFile applies a patch file from the config repository, at the
+ * revision being built, to the named repository in src/ of dir.
+ */
+func (e *Executor) ApplyPatchFile(repo *Repo, dir, name string, pf *PatchFile) error {
+	b, err := pf.Read(e.ConfigRoot(e.at))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(``, `tsb-*.patch`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return repo.Am(dir, name, tmp.Name())
+}
@@ -25,17 +25,20 @@ var verbose bool
 
 func main() {
 	sshForGit()
+	handleSignals()
 
 	var ex Executor
 	ex.cmds = os.Args[1:]
 
 	for ex.HasArg() {
 		/* fmt.Fprintf(os.Stderr, "Executing command: %v\n", ex.cmds[0]) */
-		err := ex.Execute()
+		err := ex.Cancelled(ex.Execute(), 0)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
-			/* For now just adding an error exit code. This can be done with more finese in the future
-			   with the proper code passed around but this works for now */
+			/* Interruptions and timeouts have their own exit codes; anything else is 1. */
+			if coded, ok := err.(interface{ ExitCode() int }); ok {
+				os.Exit(coded.ExitCode())
+			}
 			os.Exit(1)
 			break
 		}
@@ -0,0 +1,292 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/comcast/tsb/loadfiles"
+	"gopkg.in/yaml.v3"
+)
+
+type UpdateOptions struct {
+	/* Verify applies the patches to the new heads before storing them. */
+	Verify bool
+	/* VerifyBuild additionally runs the build against the new heads. */
+	VerifyBuild bool
+	/* Repos limits the update to the named repositories. */
+	Repos []string
+	/* Except excludes the named repositories from the update. */
+	Except []string
+	/* Revs maps repositories to the revision to update them to, instead of
+	 * the tip of their branch.
+	 */
+	Revs map[string]string
+}
+
+/* UpdateOptions consumes the update flags and repository names that follow
+ * the update command. A command that follows is left for it; any other
+ * argument is an unknown repository.
+ */
+func (e *Executor) UpdateOptions(cfg *Config) (UpdateOptions, error) {
+	var opts UpdateOptions
+	except := false
+args:
+	for e.HasArg() {
+		arg := e.PeekArg()
+		switch arg {
+		case `--verify`:
+			opts.Verify = true
+		case `--verify-build`:
+			opts.Verify = true
+			opts.VerifyBuild = true
+		case `--except`:
+			except = true
+		default:
+			name, rev := ParseRepoRev(arg)
+			if _, ok := cfg.Repos[name]; !ok {
+				if rev == `` && e.IsCommand(arg) {
+					break args
+				}
+				return opts, fmt.Errorf(`"%s" is not a valid repository.`, name)
+			}
+			if rev != `` {
+				if opts.Revs == nil {
+					opts.Revs = make(map[string]string)
+				}
+				opts.Revs[name] = rev
+				opts.Repos = append(opts.Repos, name)
+			} else if except {
+				opts.Except = append(opts.Except, arg)
+			} else {
+				opts.Repos = append(opts.Repos, arg)
+			}
+		}
+		e.PopArg()
+	}
+	if except && len(opts.Except) == 0 {
+		return opts, errors.New(`No repositories provided to --except.`)
+	}
+	return opts, nil
+}
+
+/* Select returns the repositories chosen by the options. */
+func (opts UpdateOptions) Select(rs Repos) Repos {
+	selected := make(Repos)
+	if len(opts.Repos) == 0 {
+		for name, repo := range rs {
+			selected[name] = repo
+		}
+	} else {
+		for _, name := range opts.Repos {
+			selected[name] = rs[name]
+		}
+	}
+	for _, name := range opts.Except {
+		delete(selected, name)
+	}
+	return selected
+}
+
+func (e *Executor) Update() error {
+	if e.at != `` {
+		return errors.New("Cannot update from alternate revision.")
+	}
+	cfg, err := e.Config(``)
+	if err != nil {
+		return err
+	}
+	opts, err := e.UpdateOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	repos := opts.Select(cfg.Repos)
+	if len(repos) == 0 {
+		return errors.New("No repositories selected for update.")
+	}
+
+	err = repos.forAllRepos(func(r *Repo, dir, name string) error {
+		if rev, ok := opts.Revs[name]; ok {
+			return r.UpdateTo(dir, name, rev)
+		}
+		return r.Update(dir, name)
+	}, e.Dir())
+	if err != nil {
+		return err
+	}
+
+	for name, repo := range repos {
+		for _, patch_item := range cfg.Patches[name] {
+			if patch_item.Sub != nil {
+				err = patch_item.Sub.Refresh(e.Dir(), name, repo.Head)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if opts.Verify {
+		err = e.Verify(cfg, opts.VerifyBuild)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.storeUpdate(cfg, repos)
+}
+
+/* storeUpdate writes the heads of the updated repos and their refreshed
+ * subscriptions back to repos.yml and patches.yml, leaving the text of
+ * everything else in them untouched. Should the files hold something that
+ * cannot be edited in place, the whole config is stored instead.
+ */
+func (e *Executor) storeUpdate(cfg *Config, repos Repos) error {
+	var file loadfiles.File = loadfiles.OsFile(e.Dir())
+	if dryRun {
+		file = dryRunFile(e.Dir())
+	}
+	for _, store := range []struct {
+		name   string
+		update func(src []byte) ([]byte, error)
+	}{
+		{`repos.yml`, func(src []byte) ([]byte, error) { return updatedRepos(src, repos) }},
+		{`patches.yml`, func(src []byte) ([]byte, error) { return updatedPatches(src, cfg.Patches, repos) }},
+	} {
+		src, err := ioutil.ReadFile(filepath.Join(e.Dir(), store.name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b, err := store.update(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: unable to update %s in place, storing the whole config: %s\n", store.name, err)
+			return e.StoreConfig(cfg)
+		}
+		if bytes.Equal(b, src) {
+			continue
+		}
+		w, err := file.In(store.name).Create()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* updatedRepos is repos.yml, src, with the heads and build strategies of
+ * repos set.
+ */
+func updatedRepos(src []byte, repos Repos) ([]byte, error) {
+	y, root, err := newYamlEdit(src)
+	if err != nil {
+		return nil, err
+	}
+	for name, repo := range repos {
+		if root == nil {
+			return nil, fmt.Errorf("%s is missing", name)
+		}
+		_, m, err := y.entry(root, name)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, fmt.Errorf("%s is missing", name)
+		}
+		if err := y.SetScalar(m, `build-strategy`, string(repo.BuildStrategy)); err != nil {
+			return nil, err
+		}
+		if err := y.SetScalar(m, `head`, repo.Head); err != nil {
+			return nil, err
+		}
+	}
+	return y.Bytes(), nil
+}
+
+/* updatedPatches is patches.yml, src, with the changesets of the
+ * subscriptions of repos set from patches.
+ */
+func updatedPatches(src []byte, patches Patches, repos Repos) ([]byte, error) {
+	y, root, err := newYamlEdit(src)
+	if err != nil {
+		return nil, err
+	}
+	for name := range repos {
+		var items *yaml.Node
+		for i, patch := range patches[name] {
+			if patch.Sub == nil {
+				continue
+			}
+			if items == nil {
+				if root != nil {
+					_, items, err = y.entry(root, name)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if items == nil || items.Kind != yaml.SequenceNode || len(items.Content) != len(patches[name]) {
+					return nil, fmt.Errorf("patches of %s do not match", name)
+				}
+			}
+			if err := y.SetChangesets(items.Content[i], `changesets`, patch.Sub.Changesets); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return y.Bytes(), nil
+}
+
+/* ParseRepoRev splits a {repo}@{rev} argument. */
+func ParseRepoRev(arg string) (string, string) {
+	parts := strings.SplitN(arg, `@`, 2)
+	if len(parts) == 1 {
+		return arg, ``
+	}
+	return parts[0], parts[1]
+}
+
+/* Verify performs a trial build of cfg without storing it, so that an update
+ * is only recorded if its patches still apply (and, if build is set, if the
+ * result still builds).
+ */
+func (e *Executor) Verify(cfg *Config, build bool) error {
+	wrap := func(err error) error {
+		if perr, ok := err.(*PatchError); ok {
+			return fmt.Errorf("Update not stored; patch %s blocks repository %s:\n%s", perr.Patch, perr.Repo, perr.Err.Error())
+		}
+		return errors.New("Update not stored; " + err.Error())
+	}
+
+	err := e.BuildInWorktree(cfg, BuildOptions{}, build)
+	if err != nil {
+		return wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testRepos = `# Repositories built into the product.
+kept:
+  src: https://example.com/kept.git   # mirrored
+  branch: "release"
+  head: 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa'
+updated:
+  src: https://example.com/updated.git
+  branch: main
+  head: bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb # pinned
+added:
+  src: https://example.com/added.git
+  branch: main
+`
+
+func TestUpdatedRepos(t *testing.T) {
+	repos := Repos{
+		`updated`: {BuildStrategy: BuildStrategyCherry, Head: `cccccccccccccccccccccccccccccccccccccccc`},
+		`added`:   {BuildStrategy: BuildStrategyMerge, Head: `dddddddddddddddddddddddddddddddddddddddd`},
+	}
+	b, err := updatedRepos([]byte(testRepos), repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Repositories built into the product.
+kept:
+  src: https://example.com/kept.git   # mirrored
+  branch: "release"
+  head: 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa'
+updated:
+  src: https://example.com/updated.git
+  branch: main
+  head: cccccccccccccccccccccccccccccccccccccccc # pinned
+  build-strategy: cherry
+added:
+  src: https://example.com/added.git
+  branch: main
+  build-strategy: merge
+  head: dddddddddddddddddddddddddddddddddddddddd
+`
+	if string(b) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b)
+	}
+}
+
+const testPatches = `kept:
+    - branch: origin/feature
+      changesets:
+        - 1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a # <date!a@b> kept change
+    - 2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b
+updated:
+    - 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c # pinned
+    - branch: origin/feature
+      merges: skip
+      changesets:
+        - 4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d # <date!a@b> old change
+    - branch: origin/other
+      changesets: []
+    - branch: origin/empty
+`
+
+func TestUpdatedPatches(t *testing.T) {
+	var patches Patches
+	if err := yaml.Unmarshal([]byte(testPatches), &patches); err != nil {
+		t.Fatal(err)
+	}
+	updated := patches[`updated`]
+	updated[1].Sub.Changesets = []Changeset{
+		{Node: `4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d`, Ref: `<date!a@b>`, Comment: `old change`},
+		{Node: `5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e`, Ref: `<date!a@b>`, Comment: `new change`},
+	}
+	updated[2].Sub.Changesets = []Changeset{{Node: `6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f`}}
+	updated[3].Sub.Changesets = []Changeset{{Node: `7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a`, Ref: `<date!a@b>`}}
+	/* Refreshed, but left unselected. */
+	patches[`kept`][0].Sub.Changesets = nil
+
+	b, err := updatedPatches([]byte(testPatches), patches, Repos{`updated`: {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `kept:
+    - branch: origin/feature
+      changesets:
+        - 1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a # <date!a@b> kept change
+    - 2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b2b
+updated:
+    - 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c # pinned
+    - branch: origin/feature
+      merges: skip
+      changesets:
+        - 4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d # <date!a@b> old change
+        - 5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e # <date!a@b> new change
+    - branch: origin/other
+      changesets:
+          - 6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f6f
+    - branch: origin/empty
+      changesets:
+          - 7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a # <date!a@b>
+`
+	if string(b) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b)
+	}
+
+	var stored Patches
+	if err := yaml.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !changesetsEqual(stored[`updated`][1].Sub.Changesets, updated[1].Sub.Changesets) {
+		t.Errorf("Expected changesets %v, got %v", updated[1].Sub.Changesets, stored[`updated`][1].Sub.Changesets)
+	}
+}
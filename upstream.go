@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/mail"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type UpstreamStatus string
+
+const (
+	// UpstreamProposed is a patch that has been sent upstream for review.
+	UpstreamProposed = UpstreamStatus("proposed")
+	// UpstreamMerged is a patch that has been accepted upstream.
+	UpstreamMerged = UpstreamStatus("merged")
+	// UpstreamRejected is a patch that upstream has declined.
+	UpstreamRejected = UpstreamStatus("rejected")
+	// UpstreamLocalOnly is a patch that is not meant to go upstream.
+	UpstreamLocalOnly = UpstreamStatus("local-only")
+	// UpstreamUntracked represents a patch with no upstream status.
+	UpstreamUntracked = UpstreamStatus("")
+)
+
+var UpstreamStatuses = []UpstreamStatus{
+	UpstreamLocalOnly,
+	UpstreamProposed,
+	UpstreamMerged,
+	UpstreamRejected,
+	UpstreamUntracked,
+}
+
+func (s UpstreamStatus) String() string {
+	if s == UpstreamUntracked {
+		return `untracked`
+	}
+	return string(s)
+}
+
+/* Upstream tracks the progress of a patch towards its upstream project. */
+type Upstream struct {
+	URL    string         `yaml:"url,omitempty"`
+	Status UpstreamStatus `yaml:"status,omitempty"`
+	Owner  string         `yaml:"owner,omitempty"`
+}
+
+func (u *Upstream) String() string {
+	s := u.Status.String()
+	if u.URL != `` {
+		s += ` ` + u.URL
+	}
+	if u.Owner != `` {
+		s += ` (` + u.Owner + `)`
+	}
+	return s
+}
+
+/* UpstreamInfo returns the upstream metadata of the patch, if any. */
+func (l Patch) UpstreamInfo() *Upstream {
+	switch {
+	case l.Sub != nil:
+		return l.Sub.Upstream
+	case l.File != nil:
+		return l.File.Upstream
+	}
+	return l.Upstream
+}
+
+/* Describe names the patch for reports. */
+func (l Patch) Describe() string {
+	switch {
+	case l.Sub != nil:
+		return `subscription to ` + l.Sub.Branch
+	case l.File != nil:
+		return `file ` + l.File.Path
+	}
+	if l.Change.Comment != `` {
+		return l.Change.Node + ` ` + l.Change.Comment
+	}
+	return l.Change.Node
+}
+
+/* changesetDate returns the author date of a changeset, from its reference if
+ * possible.
+ */
+func changesetDate(g gitRepo, chg Changeset) (time.Time, error) {
+	ref := strings.TrimPrefix(chg.Ref, `<`)
+	if i := strings.Index(ref, `!`); i >= 0 {
+		if t, err := time.Parse(time.RFC3339, ref[:i]); err == nil {
+			return t, nil
+		}
+	}
+	b, err := g.git(`log`, `-n1`, `--format=%aI`, chg.Node)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, string(bytes.TrimSpace(b)))
+}
+
+/* mboxDate returns the date of the first message in a mailbox. */
+func mboxDate(mbox []byte) (time.Time, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(mbox))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, `Date:`) {
+			return mail.ParseDate(strings.TrimSpace(strings.TrimPrefix(line, `Date:`)))
+		}
+	}
+	return time.Time{}, fmt.Errorf("No date in patch file")
+}
+
+/* PatchDate returns the author date of a patch; the oldest of its commits
+ * for subscriptions.
+ */
+func (e *Executor) PatchDate(repo string, p Patch) (time.Time, error) {
+	g := gitRepo(path.Join(e.Dir(), `src`, repo))
+	switch {
+	case p.Sub != nil:
+		var oldest time.Time
+		for _, chg := range p.Sub.Changesets {
+			t, err := changesetDate(g, chg)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if oldest.IsZero() || t.Before(oldest) {
+				oldest = t
+			}
+		}
+		return oldest, nil
+	case p.File != nil:
+		b, err := p.File.Read(e.ConfigRoot(e.at))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return mboxDate(b)
+	}
+	return changesetDate(g, p.Change)
+}
+
+func ageInDays(t time.Time) int {
+	return int(time.Since(t).Hours() / 24)
+}
+
+/* UpstreamReport summarizes, per repository, how many patches are in each
+ * upstream state, listing those that are still carried locally.
+ */
+func (e *Executor) UpstreamReport() error {
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		return err
+	}
+
+	var repos []string
+	for repo := range cfg.Patches {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		fmt.Printf("Upstream report for %s:\n", repo)
+
+		byStatus := make(map[UpstreamStatus][]Patch)
+		for _, p := range cfg.Patches[repo] {
+			status := UpstreamUntracked
+			if u := p.UpstreamInfo(); u != nil {
+				status = u.Status
+			}
+			byStatus[status] = append(byStatus[status], p)
+		}
+
+		for _, status := range UpstreamStatuses {
+			patches := byStatus[status]
+			delete(byStatus, status)
+			e.printUpstreamStatus(repo, status, patches)
+		}
+		for status, patches := range byStatus {
+			e.printUpstreamStatus(repo, status, patches)
+		}
+	}
+	return nil
+}
+
+func (e *Executor) printUpstreamStatus(repo string, status UpstreamStatus, patches []Patch) {
+	var oldest time.Time
+	for _, p := range patches {
+		if t, err := e.PatchDate(repo, p); err == nil && !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		fmt.Printf("\t%-12s %3d\n", status.String()+`:`, len(patches))
+	} else {
+		fmt.Printf("\t%-12s %3d  oldest %d days\n", status.String()+`:`, len(patches), ageInDays(oldest))
+	}
+
+	if status == UpstreamMerged || status == UpstreamRejected {
+		return
+	}
+	for _, p := range patches {
+		age := `unknown age`
+		if t, err := e.PatchDate(repo, p); err == nil && !t.IsZero() {
+			age = fmt.Sprintf(`%d days`, ageInDays(t))
+		}
+		if u := p.UpstreamInfo(); u != nil && (u.URL != `` || u.Owner != ``) {
+			fmt.Printf("\t\t%s (%s): %s\n", p.Describe(), age, u)
+		} else {
+			fmt.Printf("\t\t%s (%s)\n", p.Describe(), age)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/comcast/tsb/loadfiles"
+	"gopkg.in/yaml.v3"
+)
+
+/* Problem is an issue found while validating the config. */
+type Problem struct {
+	File    string
+	Line    int
+	Msg     string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	kind := `error`
+	if p.Warning {
+		kind = `warning`
+	}
+	if p.Line > 0 {
+		return fmt.Sprintf(`%s:%d: %s: %s`, p.File, p.Line, kind, p.Msg)
+	}
+	return fmt.Sprintf(`%s: %s: %s`, p.File, kind, p.Msg)
+}
+
+type Problems []Problem
+
+func (ps *Problems) Add(file string, node *yaml.Node, format string, args ...interface{}) {
+	p := Problem{File: file, Msg: fmt.Sprintf(format, args...)}
+	if node != nil {
+		p.Line = node.Line
+	}
+	*ps = append(*ps, p)
+}
+
+func (ps *Problems) Warn(file string, node *yaml.Node, format string, args ...interface{}) {
+	ps.Add(file, node, format, args...)
+	(*ps)[len(*ps)-1].Warning = true
+}
+
+func (ps Problems) Errors() int {
+	n := 0
+	for _, p := range ps {
+		if !p.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+/* yamlDoc is a parsed config file, kept as nodes so problems can be located. */
+type yamlDoc struct {
+	Name string
+	Root *yaml.Node
+	/* Origins maps nodes merged in from other files to those files. */
+	Origins map[*yaml.Node]string
+}
+
+/* File returns the name of the file node came from. */
+func (doc *yamlDoc) File(node *yaml.Node) string {
+	if file, ok := doc.Origins[node]; ok {
+		return file
+	}
+	return doc.Name
+}
+
+func loadYamlDoc(root loadfiles.File, name string, problems *Problems) *yamlDoc {
+	doc := &yamlDoc{Name: name}
+	f, err := root.In(name).Open()
+	if err != nil {
+		problems.Add(name, nil, `unable to open: %s`, err.Error())
+		return doc
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		problems.Add(name, nil, `unable to read: %s`, err.Error())
+		return doc
+	}
+
+	var node yaml.Node
+	err = yaml.Unmarshal(b, &node)
+	if err != nil {
+		problems.Add(name, nil, `%s`, err.Error())
+		return doc
+	}
+	if len(node.Content) > 0 {
+		doc.Root = node.Content[0]
+	}
+	return doc
+}
+
+/* loadComposeDoc loads the merged compose files with variables substituted,
+ * as the build sees them.
+ */
+func loadComposeDoc(root loadfiles.File, problems *Problems) *yamlDoc {
+	doc := &yamlDoc{Name: ComposeFile}
+	src, err := loadComposeSource(root)
+	if err != nil {
+		problems.Add(doc.Name, nil, `%s`, err.Error())
+		return doc
+	}
+	doc.Name = src.Files[0]
+	doc.Origins = src.Origins
+	if src.Root != nil && len(src.Root.Content) > 0 {
+		doc.Root = src.Root.Content[0]
+	}
+	return doc
+}
+
+/* mappingPairs returns the key and value nodes of a mapping in order. */
+func mappingPairs(node *yaml.Node) (keys, values []*yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i])
+		values = append(values, node.Content[i+1])
+	}
+	return keys, values
+}
+
+/* mappingValue returns the value for key in a mapping, or nil. */
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	keys, values := mappingPairs(node)
+	for i, k := range keys {
+		if k.Value == key {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+var fullHash = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+func (e *Executor) Validate() error {
+	var problems Problems
+	root := e.ConfigRoot(e.at)
+
+	cfg, err := e.Config(e.at)
+	if err != nil {
+		problems.Add(`config`, nil, `%s`, err.Error())
+	}
+
+	repos := loadYamlDoc(root, `repos.yml`, &problems)
+	patches := loadYamlDoc(root, `patches.yml`, &problems)
+	compose := loadComposeDoc(root, &problems)
+
+	remotes := validateRepos(repos, &problems)
+	validatePatches(patches, remotes, root, &problems)
+	e.validateCompose(compose, remotes, &problems)
+
+	if cfg != nil {
+		validateComposeIssues(compose, cfg.Compose, &problems)
+		e.validateStale(cfg, &problems)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.String())
+	}
+	if n := problems.Errors(); n > 0 {
+		return fmt.Errorf("Invalid config: %d problems found.", n)
+	}
+	fmt.Println("Valid config.")
+	return nil
+}
+
+/* validateRepos checks repos.yml, returning the remotes of each repository. */
+func validateRepos(doc *yamlDoc, problems *Problems) map[string]map[string]bool {
+	remotes := make(map[string]map[string]bool)
+	if doc.Root == nil {
+		return remotes
+	}
+	if doc.Root.Kind != yaml.MappingNode {
+		problems.Add(doc.Name, doc.Root, `expected a mapping of repositories`)
+		return remotes
+	}
+
+	names, repos := mappingPairs(doc.Root)
+	for i, repo := range repos {
+		name := names[i].Value
+		remotes[name] = map[string]bool{`origin`: true}
+		if repo.Kind != yaml.MappingNode {
+			problems.Add(doc.Name, repo, `repository %s must be a mapping`, name)
+			continue
+		}
+
+		if src := mappingValue(repo, `src`); src == nil || src.Value == `` {
+			problems.Add(doc.Name, names[i], `repository %s has no src`, name)
+		}
+
+		branch, tag := mappingValue(repo, `branch`), mappingValue(repo, `tag`)
+		if (branch == nil || branch.Value == ``) == (tag == nil || tag.Value == ``) {
+			problems.Add(doc.Name, names[i], `repository %s must have exactly one of branch or tag`, name)
+		}
+
+		if strategy := mappingValue(repo, `build-strategy`); strategy != nil {
+			switch BuildStrategy(strategy.Value) {
+			case BuildStrategyCherry, BuildStrategyMerge:
+			default:
+				problems.Add(doc.Name, strategy, `repository %s has unknown build-strategy %q`, name, strategy.Value)
+			}
+		}
+
+		if head := mappingValue(repo, `head`); head == nil || head.Value == `` {
+			problems.Add(doc.Name, names[i], `repository %s has no head; run tsb update`, name)
+		} else if !fullHash.MatchString(head.Value) {
+			problems.Add(doc.Name, head, `head of repository %s is not a full hash: %q`, name, head.Value)
+		}
+
+		extras := mappingValue(repo, `extra`)
+		if extras == nil {
+			continue
+		}
+		if extras.Kind != yaml.SequenceNode {
+			problems.Add(doc.Name, extras, `extra of repository %s must be a list`, name)
+			continue
+		}
+		for j, extra := range extras.Content {
+			remote := fmt.Sprintf(`extra%02d`, j)
+			if extra.Kind == yaml.MappingNode {
+				nameNode, pathNode := mappingValue(extra, `name`), mappingValue(extra, `path`)
+				if nameNode == nil || nameNode.Value == `` || pathNode == nil || pathNode.Value == `` {
+					problems.Add(doc.Name, extra, `extra of repository %s requires both name and path`, name)
+					continue
+				}
+				remote = nameNode.Value
+			} else if extra.Kind != yaml.ScalarNode || extra.Value == `` {
+				problems.Add(doc.Name, extra, `extra of repository %s must be a string or a name and path`, name)
+				continue
+			}
+			if remotes[name][remote] {
+				problems.Add(doc.Name, extra, `repository %s has more than one remote named %s`, name, remote)
+			}
+			remotes[name][remote] = true
+		}
+	}
+	return remotes
+}
+
+/* validatePatches checks patches.yml against the repositories and their remotes. */
+func validatePatches(doc *yamlDoc, remotes map[string]map[string]bool, root loadfiles.File, problems *Problems) {
+	if doc.Root == nil {
+		return
+	}
+	if doc.Root.Kind == yaml.ScalarNode && doc.Root.Tag == `!!null` {
+		return
+	}
+	if doc.Root.Kind != yaml.MappingNode {
+		problems.Add(doc.Name, doc.Root, `expected a mapping of repositories`)
+		return
+	}
+
+	names, lists := mappingPairs(doc.Root)
+	for i, list := range lists {
+		name := names[i].Value
+		if _, ok := remotes[name]; !ok {
+			problems.Add(doc.Name, names[i], `patches for unknown repository %s`, name)
+		}
+		if list.Kind != yaml.SequenceNode {
+			if !(list.Kind == yaml.ScalarNode && list.Tag == `!!null`) {
+				problems.Add(doc.Name, list, `patches for %s must be a list`, name)
+			}
+			continue
+		}
+
+		seen := make(map[string]int)
+		checkChangeset := func(node *yaml.Node) {
+			if node.Kind != yaml.ScalarNode || node.Value == `` {
+				problems.Add(doc.Name, node, `changeset in %s must be a hash`, name)
+				return
+			}
+			if line, ok := seen[node.Value]; ok {
+				problems.Add(doc.Name, node, `changeset %s in %s duplicates line %d`, node.Value, name, line)
+				return
+			}
+			seen[node.Value] = node.Line
+		}
+
+		for _, item := range list.Content {
+			if item.Kind == yaml.ScalarNode {
+				checkChangeset(item)
+				continue
+			}
+			if item.Kind != yaml.MappingNode {
+				problems.Add(doc.Name, item, `unrecognized patch in %s`, name)
+				continue
+			}
+
+			switch {
+			case mappingValue(item, `commit`) != nil:
+				checkChangeset(mappingValue(item, `commit`))
+			case mappingValue(item, `file`) != nil:
+				file := mappingValue(item, `file`)
+				if f, err := root.In(file.Value).Open(); err != nil {
+					problems.Add(doc.Name, file, `patch file %s not found`, file.Value)
+				} else {
+					f.Close()
+				}
+			case mappingValue(item, `branch`) != nil:
+				branch := mappingValue(item, `branch`)
+				parts := strings.SplitN(branch.Value, `/`, 2)
+				if len(parts) != 2 {
+					problems.Add(doc.Name, branch, `subscription %s in %s must be {remote}/{branch}`, branch.Value, name)
+				} else if rs, ok := remotes[name]; ok && !rs[parts[0]] {
+					problems.Add(doc.Name, branch, `subscription %s in %s refers to unknown remote %s`, branch.Value, name, parts[0])
+				}
+				if merges := mappingValue(item, `merges`); merges != nil {
+					switch MergePolicy(merges.Value) {
+					case MergePolicyFail, MergePolicySkip, MergePolicyFirstParent:
+					default:
+						problems.Add(doc.Name, merges, `unknown merge policy %q`, merges.Value)
+					}
+				}
+				if changesets := mappingValue(item, `changesets`); changesets != nil {
+					for _, cs := range changesets.Content {
+						checkChangeset(cs)
+					}
+				}
+			default:
+				problems.Add(doc.Name, item, `unrecognized patch in %s`, name)
+			}
+
+			if upstream := mappingValue(item, `upstream`); upstream != nil {
+				if status := mappingValue(upstream, `status`); status != nil {
+					switch UpstreamStatus(status.Value) {
+					case UpstreamProposed, UpstreamMerged, UpstreamRejected, UpstreamLocalOnly:
+					default:
+						problems.Add(doc.Name, status, `unknown upstream status %q`, status.Value)
+					}
+				}
+			}
+		}
+	}
+}
+
+/* validateCompose checks that volumes under ./src refer to known repositories
+ * that exist.
+ */
+func (e *Executor) validateCompose(doc *yamlDoc, remotes map[string]map[string]bool, problems *Problems) {
+	if doc.Root == nil {
+		return
+	}
+	services := mappingValue(doc.Root, `services`)
+	if services == nil {
+		problems.Add(doc.Name, doc.Root, `no services defined`)
+		return
+	}
+
+	names, svcs := mappingPairs(services)
+	for i, svc := range svcs {
+		volumes := mappingValue(svc, `volumes`)
+		if volumes == nil {
+			continue
+		}
+		for _, vol := range volumes.Content {
+			source := vol.Value
+			if vol.Kind == yaml.MappingNode {
+				if s := mappingValue(vol, `source`); s != nil {
+					source = s.Value
+				}
+			} else {
+				source = strings.SplitN(source, `:`, 2)[0]
+			}
+
+			rel := strings.TrimPrefix(source, `./`)
+			if !strings.HasPrefix(rel, `src/`) {
+				continue
+			}
+			repo := strings.SplitN(strings.TrimPrefix(rel, `src/`), `/`, 2)[0]
+			if _, ok := remotes[repo]; !ok {
+				problems.Add(doc.File(vol), vol, `service %s mounts %s, which is not a configured repository`, names[i].Value, source)
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(e.Dir(), rel)); err != nil {
+				problems.Add(doc.File(vol), vol, `service %s mounts %s, which does not exist; run tsb fetch prebuild`, names[i].Value, source)
+			}
+		}
+	}
+}
+
+/* validateComposeIssues reports the compose features tsb does not support
+ * with the engine the compose file selects, locating them in the compose
+ * file where possible.
+ */
+func validateComposeIssues(doc *yamlDoc, compose Compose, problems *Problems) {
+	options, err := compose.Options()
+	host := err == nil && options.Engine == `host`
+	for _, issue := range compose.Issues(host) {
+		node := doc.Root
+		if issue.Service != `` {
+			services := mappingValue(doc.Root, `services`)
+			keys, svcs := mappingPairs(services)
+			for i, key := range keys {
+				if key.Value == issue.Service {
+					node = key
+					if issue.Key != `` {
+						svcKeys, _ := mappingPairs(svcs[i])
+						for _, svcKey := range svcKeys {
+							if svcKey.Value == issue.Key {
+								node = svcKey
+							}
+						}
+					}
+				}
+			}
+		} else if issue.Key != `` {
+			keys, _ := mappingPairs(doc.Root)
+			for _, key := range keys {
+				if key.Value == issue.Key {
+					node = key
+				}
+			}
+		}
+
+		if issue.Fatal {
+			problems.Add(doc.File(node), node, `%s`, issue)
+		} else {
+			problems.Warn(doc.File(node), node, `%s`, issue)
+		}
+	}
+}
+
+/* validateStale warns about patches past the thresholds in the x-tsb options. */
+func (e *Executor) validateStale(cfg *Config, problems *Problems) {
+	opts, err := cfg.Compose.Options()
+	if err != nil {
+		problems.Add(`docker-compose.yml`, nil, `%s`, err.Error())
+		return
+	}
+	if opts.StalePatchDays <= 0 && opts.StalePatchUpdates <= 0 {
+		return
+	}
+
+	ages, err := e.PatchAges(cfg)
+	if err != nil {
+		problems.Warn(`patches.yml`, nil, `unable to determine patch ages: %s`, err.Error())
+		return
+	}
+	var repos []string
+	for repo := range ages {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		for _, age := range ages[repo] {
+			if reason := opts.Stale(age); reason != `` {
+				problems.Warn(`patches.yml`, nil, `stale patch %s in %s: %s`, age.Patch.Describe(), repo, reason)
+			}
+		}
+	}
+}
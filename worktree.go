@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* WorktreesDir holds, within src/, the sources of the builds in progress. */
+const WorktreesDir = `.worktrees`
+
+/* SrcEnv is set to the directory holding the sources of a build, so that
+ * compose files can mount them as ${TSB_SRC:-./src}/{repo}.
+ */
+const SrcEnv = `TSB_SRC`
+
+/* worktreeOwner records the pid of the tsb process building in a worktree. */
+const worktreeOwner = `tsb.pid`
+
+/* Worktree is the directory of a build's own sources: its src/ holds a git
+ * worktree of each repository in src/ of the config repository, so that
+ * builds do not share checkouts. When building another revision of the
+ * config repository, its config/ holds a checkout of that too.
+ */
+type Worktree string
+
+/* Src is the directory holding the worktrees of the repositories. */
+func (w Worktree) Src() string {
+	return filepath.Join(string(w), `src`)
+}
+
+/* NewWorktree creates the directory for a build's worktrees, after removing
+ * those left by builds that are no longer running.
+ */
+func (e *Executor) NewWorktree(cfg *Config) (Worktree, error) {
+	root := filepath.Join(e.Dir(), `src`, WorktreesDir)
+	if dryRun {
+		return Worktree(filepath.Join(root, `build-dry-run`)), nil
+	}
+	cfg.Repos.PruneWorktrees(e.Dir())
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return ``, err
+	}
+	dir, err := ioutil.TempDir(root, `build-`)
+	if err != nil {
+		return ``, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, worktreeOwner), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return ``, err
+	}
+	return Worktree(dir), nil
+}
+
+func (rs Repos) PrepareWorktree(dir string, w Worktree) error {
+	return rs.forAllRepos(func(r *Repo, dir, name string) error {
+		return r.PrepareWorktree(dir, name, w)
+	}, dir)
+}
+
+/* PrepareWorktree checks out the head in a new worktree of the repository
+ * in w.
+ */
+func (r *Repo) PrepareWorktree(dir, name string, w Worktree) error {
+	repo := gitRepo(filepath.Join(dir, `src`, name))
+	_, err := repo.git(`worktree`, `add`, `--detach`, `--force`, filepath.Join(w.Src(), name), r.Head)
+	if err != nil {
+		return errors.New(`Unable to check out head in a worktree ` + err.Error())
+	}
+	return nil
+}
+
+/* CheckoutConfig checks out the config repository at the revision being
+ * built in w, so that the build contexts and other files the compose file
+ * refers to are those of that revision. Its src/ and dist/ link to those of
+ * the config repository. It returns the directory of the checkout, which is
+ * named like the config repository, so that the compose project is too.
+ */
+func (e *Executor) CheckoutConfig(w Worktree) (string, error) {
+	dir := filepath.Join(string(w), `config`, filepath.Base(e.Dir()))
+	_, err := gitRepo(e.Dir()).git(`worktree`, `add`, `--detach`, `--force`, dir, e.at+`^{commit}`)
+	if err != nil {
+		return ``, errors.New(`Unable to check out the config repository at ` + e.at + `: ` + err.Error())
+	}
+	if dryRun {
+		return dir, nil
+	}
+	for _, sub := range []string{`src`, `dist`} {
+		link := filepath.Join(dir, sub)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		err := os.Symlink(filepath.Join(e.Dir(), sub), link)
+		if err != nil {
+			return ``, err
+		}
+	}
+	return dir, nil
+}
+
+/* worktreeRepo returns the repository in src/ that the worktree at p is
+ * made from, or nothing if p is not the worktree of a build.
+ */
+func worktreeRepo(p string) string {
+	src := filepath.Dir(p)
+	worktrees := filepath.Dir(filepath.Dir(src))
+	if filepath.Base(src) != `src` || filepath.Base(worktrees) != WorktreesDir {
+		return ``
+	}
+	return filepath.Join(filepath.Dir(worktrees), filepath.Base(p))
+}
+
+/* RemoveWorktree removes the worktrees of a build. */
+func (rs Repos) RemoveWorktree(dir string, w Worktree) {
+	if dryRun {
+		return
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Removing %s.\n", w)
+	}
+	err := os.RemoveAll(string(w))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove %s: %s\n", w, err.Error())
+	}
+	rs.pruneWorktrees(dir)
+}
+
+/* PruneWorktrees removes the worktrees of builds that are no longer running,
+ * such as those killed before they could clean up.
+ */
+func (rs Repos) PruneWorktrees(dir string) {
+	root := filepath.Join(dir, `src`, WorktreesDir)
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, fi := range entries {
+		w := filepath.Join(root, fi.Name())
+		b, err := ioutil.ReadFile(filepath.Join(w, worktreeOwner))
+		if err != nil {
+			/* A build that has only just created its directory has yet to
+			 * write its pid.
+			 */
+			if time.Since(fi.ModTime()) < time.Minute {
+				continue
+			}
+		} else if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && processAlive(pid) {
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Removing stale %s.\n", w)
+		}
+		_ = os.RemoveAll(w)
+	}
+	rs.pruneWorktrees(dir)
+}
+
+/* pruneWorktrees drops the records of removed worktrees from the
+ * repositories and the config repository.
+ */
+func (rs Repos) pruneWorktrees(dir string) {
+	_, _ = gitRepo(dir).git(`worktree`, `prune`)
+	for name := range rs {
+		repo := gitRepo(filepath.Join(dir, `src`, name))
+		_, _ = repo.git(`worktree`, `prune`)
+	}
+}
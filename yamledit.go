@@ -0,0 +1,306 @@
+/*
+Copyright 2018 Comcast Cable Communications Management, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+/* yamlEdit rewrites individual nodes of a yaml document in its original
+ * text, so that everything outside those nodes keeps its bytes, comments
+ * and formatting.
+ */
+type yamlEdit struct {
+	src     []byte
+	lines   []int
+	splices []yamlSplice
+}
+
+type yamlSplice struct {
+	start, end int
+	text       string
+}
+
+/* newYamlEdit parses src, returning the editor and the root node of the
+ * document, which is nil for an empty document.
+ */
+func newYamlEdit(src []byte) (*yamlEdit, *yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, nil, err
+	}
+	y := &yamlEdit{src: src, lines: []int{0}}
+	for i, c := range src {
+		if c == '\n' {
+			y.lines = append(y.lines, i+1)
+		}
+	}
+	if len(doc.Content) == 0 {
+		return y, nil, nil
+	}
+	return y, doc.Content[0], nil
+}
+
+func (y *yamlEdit) Changed() bool {
+	return len(y.splices) != 0
+}
+
+func (y *yamlEdit) Bytes() []byte {
+	sort.Slice(y.splices, func(i, j int) bool { return y.splices[i].start < y.splices[j].start })
+	var b bytes.Buffer
+	at := 0
+	for _, s := range y.splices {
+		b.Write(y.src[at:s.start])
+		b.WriteString(s.text)
+		at = s.end
+	}
+	b.Write(y.src[at:])
+	return b.Bytes()
+}
+
+/* offset is the position of n in the text. */
+func (y *yamlEdit) offset(n *yaml.Node) int {
+	off := y.lines[n.Line-1]
+	for col := 1; col < n.Column; col++ {
+		_, size := utf8.DecodeRune(y.src[off:])
+		off += size
+	}
+	return off
+}
+
+/* lineEnd is the position following the newline that ends the line
+ * containing off.
+ */
+func (y *yamlEdit) lineEnd(off int) int {
+	if i := bytes.IndexByte(y.src[off:], '\n'); 0 <= i {
+		return off + i + 1
+	}
+	return len(y.src)
+}
+
+/* scalarEnd is the position following the text of the single line scalar n. */
+func (y *yamlEdit) scalarEnd(n *yaml.Node) (int, error) {
+	start := y.offset(n)
+	switch n.Style {
+	case yaml.DoubleQuotedStyle:
+		for i := start + 1; i < len(y.src) && y.src[i] != '\n'; i++ {
+			switch y.src[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+	case yaml.SingleQuotedStyle:
+		for i := start + 1; i < len(y.src) && y.src[i] != '\n'; i++ {
+			if y.src[i] == '\'' {
+				if i+1 < len(y.src) && y.src[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, nil
+			}
+		}
+	case 0:
+		text := y.src[start:y.lineEnd(start)]
+		if i := bytes.Index(text, []byte(` #`)); 0 <= i {
+			text = text[:i]
+		}
+		text = bytes.TrimRight(text, " \t\r\n")
+		if string(text) == n.Value {
+			return start + len(text), nil
+		}
+	}
+	return 0, fmt.Errorf("line %d: %s is not a single line scalar", n.Line, n.Value)
+}
+
+func (y *yamlEdit) replace(start, end int, text string) {
+	y.splices = append(y.splices, yamlSplice{start: start, end: end, text: text})
+}
+
+/* entry finds the key and value of name in the mapping m. */
+func (y *yamlEdit) entry(m *yaml.Node, name string) (*yaml.Node, *yaml.Node, error) {
+	if m.Kind != yaml.MappingNode || m.Style&yaml.FlowStyle != 0 {
+		return nil, nil, fmt.Errorf("line %d: expected a block mapping", m.Line)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == name {
+			return m.Content[i], m.Content[i+1], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+/* addEntry adds lines, indented as the keys of the mapping m, after the
+ * last of its entries with a single line scalar value.
+ */
+func (y *yamlEdit) addEntry(m *yaml.Node, lines ...string) error {
+	var after *yaml.Node
+	for i := 1; i < len(m.Content); i += 2 {
+		if m.Content[i].Kind == yaml.ScalarNode && m.Content[i].Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			after = m.Content[i]
+		}
+	}
+	if after == nil {
+		return fmt.Errorf("line %d: no entry to add %s after", m.Line, lines[0])
+	}
+	indent := strings.Repeat(` `, m.Content[0].Column-1)
+	var text strings.Builder
+	at := y.lineEnd(y.offset(after))
+	if at == len(y.src) && 0 < at && y.src[at-1] != '\n' {
+		text.WriteString("\n")
+	}
+	for _, line := range lines {
+		text.WriteString(indent + line + "\n")
+	}
+	y.replace(at, at, text.String())
+	return nil
+}
+
+/* SetScalar sets name in the mapping m to value, adding it if necessary. */
+func (y *yamlEdit) SetScalar(m *yaml.Node, name, value string) error {
+	key, v, err := y.entry(m, name)
+	if err != nil {
+		return err
+	}
+	if v != nil && v.Kind == yaml.ScalarNode && v.Value == value {
+		return nil
+	}
+	text, err := yamlScalar(value)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return y.addEntry(m, name+`: `+text)
+	}
+	if v.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected %s to be a scalar", v.Line, name)
+	}
+	start := y.offset(v)
+	end, err := y.scalarEnd(v)
+	if err != nil {
+		return err
+	}
+	if v.Tag == `!!null` && v.Value == `` {
+		/* An empty value starts directly after the colon. */
+		text = ` ` + text
+	}
+	y.replace(start, end, text)
+	return nil
+}
+
+/* SetChangesets sets name in the mapping m to changesets, one per line with
+ * their ref and comment as line comments, adding it if necessary.
+ */
+func (y *yamlEdit) SetChangesets(m *yaml.Node, name string, changesets []Changeset) error {
+	key, v, err := y.entry(m, name)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		var old []Changeset
+		if err := v.Decode(&old); err != nil {
+			return err
+		}
+		if changesetsEqual(old, changesets) {
+			return nil
+		}
+	} else if len(changesets) == 0 {
+		return nil
+	}
+
+	items := make([]string, len(changesets))
+	for i, cs := range changesets {
+		node, err := yamlScalar(cs.Node)
+		if err != nil {
+			return err
+		}
+		items[i] = `- ` + node
+		if comment := strings.TrimSpace(cs.Ref + ` ` + cs.Comment); comment != `` {
+			items[i] += ` # ` + comment
+		}
+	}
+
+	if key == nil {
+		lines := []string{name + `:`}
+		for _, item := range items {
+			lines = append(lines, `    `+item)
+		}
+		return y.addEntry(m, lines...)
+	}
+
+	start := y.offset(key)
+	end := y.lineEnd(start)
+	indent := strings.Repeat(` `, key.Column-1+4)
+	if v.Kind == yaml.SequenceNode && v.Style&yaml.FlowStyle == 0 && len(v.Content) != 0 {
+		last := v.Content[len(v.Content)-1]
+		if last.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: expected %s to hold changesets", v.Line, name)
+		}
+		if _, err := y.scalarEnd(last); err != nil {
+			return err
+		}
+		end = y.lineEnd(y.offset(last))
+		indent = strings.Repeat(` `, v.Column-1)
+	} else if v.Line != key.Line {
+		return fmt.Errorf("line %d: expected %s to hold changesets", v.Line, name)
+	}
+
+	var text strings.Builder
+	if len(items) == 0 {
+		text.WriteString(name + ": []\n")
+	} else {
+		text.WriteString(name + ":\n")
+		for _, item := range items {
+			text.WriteString(indent + item + "\n")
+		}
+	}
+	if end == len(y.src) && 0 < end && y.src[end-1] != '\n' {
+		/* Keep a missing final newline missing. */
+		y.replace(start, end, strings.TrimSuffix(text.String(), "\n"))
+		return nil
+	}
+	y.replace(start, end, text.String())
+	return nil
+}
+
+/* yamlScalar is s as it appears in yaml, quoted if necessary. */
+func yamlScalar(s string) (string, error) {
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return ``, err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+func changesetsEqual(a, b []Changeset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}